@@ -0,0 +1,170 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Adapter sequences as read after the insert by the first and the second read:
+type Adapters struct {
+	Name  string
+	Read1 string
+	Read2 string
+}
+
+func NewAdapters(s string) *Adapters {
+	switch strings.ToLower(s) {
+	case "truseq":
+		return &Adapters{"truseq", "AGATCGGAAGAGCACACGTCTGAACTCCAGTCA", "AGATCGGAAGAGCGTCGTGTAGGGAAAGAGTGT"}
+	case "nextera":
+		return &Adapters{"nextera", "CTGTCTCTTATACACATCTCCGAGCCCACGAGAC", "CTGTCTCTTATACACATCTGACGCTGCCGACGA"}
+	}
+	// Custom adapters:
+	spl := strings.Split(strings.ToUpper(s), ",")
+	if len(spl) != 2 {
+		L.Fatalf("Invalid adapter specification: %s", s)
+	}
+	for _, a := range spl {
+		if len(a) == 0 || strings.Trim(a, "ACGTN") != "" {
+			L.Fatalf("Invalid adapter sequence: %s", a)
+		}
+	}
+	return &Adapters{"custom", spl[0], spl[1]}
+}
+
+// Simulate adapter dimers and short inserts, and optionally add adapters to the inserts:
+type LibraryBuilder struct {
+	Adapters   *Adapters
+	DimerRate  float64
+	ShortRate  float64
+	ReadLength uint32
+	Full       bool // Output full library molecules.
+}
+
+func NewLibraryBuilder(adapters *Adapters, dimerRate float64, shortRate float64, readLength int, full bool) *LibraryBuilder {
+	if dimerRate < 0.0 || shortRate < 0.0 || dimerRate+shortRate > 1.0 {
+		L.Fatalf("The adapter dimer and short insert rates must be non-negative and sum up to at most 1!")
+	}
+	if readLength < 2 {
+		L.Fatalf("The read length must be at least 2!")
+	}
+	lb := &LibraryBuilder{adapters, dimerRate, shortRate, uint32(readLength), full}
+	if dimerRate > 0.0 || shortRate > 0.0 || full {
+		L.PrintfV("Adapters: %s (%s, %s)", adapters.Name, adapters.Read1, adapters.Read2)
+		L.PrintfV("Adapter dimer rate: %g, short insert rate: %g, read length: %d", dimerRate, shortRate, readLength)
+	}
+	return lb
+}
+
+// Turn a sampled fragment into a library molecule:
+func (lb LibraryBuilder) Build(f Fragment, st FragStater, rand Rander) Fragment {
+	if lb.DimerRate == 0.0 && lb.ShortRate == 0.0 && !lb.Full {
+		return f
+	}
+	length := uint32(len(f.GetSeq()))
+	lf := LibFrag{Fragment: f, adapters: lb.Adapters, full: lb.Full, insertLen: length, fullLen: length}
+	u := rand.Float64()
+	switch {
+	case u < lb.DimerRate:
+		lf.dimer = true
+		lf.insertLen = 0
+		st.UpdateShortInsert(0)
+	case u < lb.DimerRate+lb.ShortRate:
+		// Chimeric inserts are not truncated:
+		if f.IsChimera() {
+			break
+		}
+		l := 1 + uint32(rand.Int63n(int64(lb.ReadLength-1)))
+		if l < lf.insertLen {
+			lf.insertLen = l
+			st.UpdateShortInsert(l)
+		}
+	}
+	return lf
+}
+
+// Library molecule: insert optionally flanked by adapters.
+type LibFrag struct {
+	Fragment
+	adapters  *Adapters
+	insertLen uint32
+	fullLen   uint32 // Length of the untruncated insert.
+	dimer     bool
+	full      bool
+}
+
+// Sequence of the insert:
+func (lf LibFrag) insert() string {
+	if lf.dimer {
+		return ""
+	}
+	return lf.Fragment.GetSeq()[:lf.insertLen]
+}
+
+func (lf LibFrag) GetSeq() string {
+	if !lf.full {
+		return lf.insert()
+	}
+	return RevCompDNA(lf.adapters.Read2) + lf.insert() + lf.adapters.Read1
+}
+
+// Adapter dimers carry no insert:
+func (lf LibFrag) GetUmi() *UmiTag {
+	if lf.dimer {
+		return nil
+	}
+	return lf.Fragment.GetUmi()
+}
+
+func (lf LibFrag) SetId(id uint64) Fragment {
+	lf.Fragment = lf.Fragment.SetId(id)
+	return lf
+}
+
+func (lf LibFrag) String() string {
+	var s string
+	switch {
+	case lf.dimer:
+		s = fmt.Sprintf(">Fg_%d_adapter_dimer (Strand + Offset 0 -- 0) Adapter=dimer", lf.GetId())
+	case lf.insertLen < lf.fullLen:
+		start, end := headCoords(lf.Fragment, lf.insertLen)
+		s = fmt.Sprintf(">Fg_%d_%s (Strand %s Offset %d -- %d)", lf.GetId(), lf.GetName(), lf.GetStrand(), start, end)
+		s += lf.GetTags() + " ShortInsert"
+	default:
+		// Header of the original fragment:
+		s = strings.SplitN(lf.Fragment.String(), "\n", 2)[0]
+	}
+	if lf.full {
+		a := uint32(len(lf.adapters.Read2))
+		s += fmt.Sprintf(" Insert=%d-%d", a, a+lf.insertLen)
+	}
+	return s + "\n" + lf.GetSeq()
+}
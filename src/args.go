@@ -32,6 +32,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -42,6 +43,19 @@ type FragMethod struct {
 	Param int
 }
 
+type PrimingParam struct {
+	Temp         float64
+	TempC        float64
+	Celsius      bool
+	KmerLength   uint32
+	MaxMismatch  int
+	NNSet        string
+	Na           float64
+	Mg           float64
+	AffinityFile string
+	PrimerFile   string
+}
+
 type EffParam struct {
 	Shape float64
 	Min   float64
@@ -53,9 +67,14 @@ type CmdArgs struct {
 	ReqFrags      int64
 	NrCycles      int64
 	StrandBias    float64
-	PrimingTemp   float64
+	LibType       string
+	AntisenseLeak float64
+	PrimingParam  *PrimingParam
 	FixedEff      float64
 	GcEffParam    *EffParam
+	GcModel       GcModel
+	EffSurface    *EffSurface
+	GcWindow      int
 	LenEffParam   *EffParam
 	ReportFile    string
 	Verbose       bool
@@ -65,8 +84,11 @@ type CmdArgs struct {
 	InputFiles    []string
 	MaxProcs      int64
 	ProfFile      string
-	KmerLength    uint32
 	GobDir        string
+	MmapStore     bool
+	MaxMem        int64
+	SaveCkpt      string
+	LoadCkpt      string
 	GCFreq        int
 	PolyAParam    *TargetMix
 	InitSeed      int64
@@ -77,17 +99,53 @@ type CmdArgs struct {
 	RawLenProbs   *LenProbStruct
 	MinRawGcEff   float64
 	ExprMul       float64
+	Lineage       bool
+	CaptureParam  string
+	InternalPrim  float64
+	MinARun       int
+	RRNAFile      string
+	RRNAFraction  float64
+	RRNADepletion float64
+	RRNAProbes    string
+	GDNAFile      string
+	GDNAFraction  float64
+	ChimeraRate   float64
+	ChimeraMh     float64
+	Adapters      string
+	DimerRate     float64
+	ShortRate     float64
+	ReadLength    int
+	FullMolecule  bool
+	PcrSubRate    float64
+	PcrIndelRate  float64
+	PcrChimRate   float64
+	PcrChimOvl    int
+	PcrCapacity   float64
+	PcrApprox     int64
+	PcrApproxCmp  bool
+	FoldMode      string
+	FoldWindow    int
+	FoldScale     float64
+	HomoMin       int
+	HomoPenalty   float64
+	FeatureFile   string
+	UmiPattern    string
+	UmiSeqError   float64
+	UmiFile       string
 }
 
 // Parse command line arguments using the flag package.
 func (a *CmdArgs) Parse() {
 	var targMix string
 	var fragMethod string
+	var maxMem string
 	var gcEffParams string
+	var gcModel string
 	var lenEffParams string
 	var polyAParams string
 	var help, version, gob bool
 	var kmerLenght int
+	var maxMismatch int
 	var randtest bool
 
 	// Default target mixture:
@@ -98,12 +156,56 @@ func (a *CmdArgs) Parse() {
 	flag.Int64Var(&a.ReqFrags, "n", 0, "Number of requested fragments.")
 	flag.StringVar(&targMix, "d", target_mix_default, "Fragment size distribution.")
 	flag.Int64Var(&a.NrCycles, "c", 11, "Number of PCR cycles.")
+	flag.Float64Var(&a.PcrSubRate, "ps", 0.0, "PCR substitution rate.")
+	flag.Float64Var(&a.PcrIndelRate, "pi", 0.0, "PCR indel rate.")
+	flag.Float64Var(&a.PcrChimRate, "pch", 0.0, "PCR chimera rate per cycle.")
+	flag.IntVar(&a.PcrChimOvl, "pco", 15, "Minimum overlap of PCR chimeras.")
+	flag.Float64Var(&a.PcrCapacity, "pk", 0.0, "PCR plateau capacity.")
+	flag.Int64Var(&a.PcrApprox, "px", 0, "Approximate PCR threshold.")
+	flag.BoolVar(&a.PcrApproxCmp, "pxc", false, "Compare approximate and exact PCR.")
+	flag.StringVar(&a.FoldMode, "hf", "none", "Hairpin folding mode.")
+	flag.IntVar(&a.FoldWindow, "hw", 30, "Length of folded fragment ends.")
+	flag.Float64Var(&a.FoldScale, "hs", 10.0, "Hairpin free energy scale.")
+	flag.IntVar(&a.HomoMin, "hr", 6, "Minimum penalized homopolymer length.")
+	flag.Float64Var(&a.HomoPenalty, "hp", 0.0, "Homopolymer penalty per base.")
+	flag.StringVar(&a.FeatureFile, "hx", "", "Export sequence feature efficiencies.")
+	flag.StringVar(&a.CaptureParam, "ac", "", "Poly(A) capture efficiency parameters.")
+	flag.Float64Var(&a.InternalPrim, "ip", 0.0, "Internal priming probability.")
+	flag.IntVar(&a.MinARun, "ipl", 12, "Minimum A-run length for internal priming.")
+	flag.StringVar(&a.RRNAFile, "rr", "", "rRNA fasta file.")
+	flag.Float64Var(&a.RRNAFraction, "rrf", 0.05, "Fraction of rRNA molecules.")
+	flag.Float64Var(&a.RRNADepletion, "rrd", 0.0, "rRNA depletion efficiency.")
+	flag.StringVar(&a.RRNAProbes, "rrp", "", "rRNA depletion probe model.")
+	flag.StringVar(&a.GDNAFile, "gd", "", "Genome fasta file.")
+	flag.Float64Var(&a.GDNAFraction, "gdf", 0.01, "Fraction of gDNA molecules.")
+	flag.Float64Var(&a.ChimeraRate, "ch", 0.0, "Chimera rate.")
+	flag.Float64Var(&a.ChimeraMh, "chm", 1.0, "Microhomology bias of chimeric junctions.")
+	flag.StringVar(&a.Adapters, "ad", "truseq", "Adapter sequences.")
+	flag.Float64Var(&a.DimerRate, "adr", 0.0, "Adapter dimer rate.")
+	flag.Float64Var(&a.ShortRate, "sir", 0.0, "Short insert rate.")
+	flag.IntVar(&a.ReadLength, "rl", 100, "Read length.")
+	flag.BoolVar(&a.FullMolecule, "fm", false, "Output full library molecules.")
+	flag.StringVar(&a.UmiPattern, "um", "", "UMI length or pattern.")
+	flag.Float64Var(&a.UmiSeqError, "ue", 0.0, "UMI sequencing error rate.")
+	flag.StringVar(&a.UmiFile, "uf", "", "UMI read file.")
 	flag.StringVar(&polyAParams, "a", polyA_mix_default, "Poly(A) tail length distribution.")
 	flag.Float64Var(&a.StrandBias, "b", 0.5, "Strand bias.")
-	flag.Float64Var(&a.PrimingTemp, "p", 5.0, "Priming bias parameter.")
+	flag.StringVar(&a.LibType, "lt", "", "Library type.")
+	flag.Float64Var(&a.AntisenseLeak, "al", 0.0, "Antisense leakage rate.")
+	a.PrimingParam = new(PrimingParam)
+	flag.Float64Var(&a.PrimingParam.Temp, "p", 5.0, "Priming bias parameter.")
 	flag.IntVar(&kmerLenght, "k", 6, "Primer length.")
+	flag.IntVar(&maxMismatch, "pmm", 0, "Maximum number of primer mismatches.")
+	flag.Float64Var(&a.PrimingParam.TempC, "pt", 0.0, "Priming temperature in Celsius.")
+	flag.StringVar(&a.PrimingParam.NNSet, "nn", "santalucia2004", "Nearest-neighbour parameter set.")
+	flag.Float64Var(&a.PrimingParam.Na, "na", 1000.0, "Monovalent salt concentration (mM).")
+	flag.Float64Var(&a.PrimingParam.Mg, "mg", 0.0, "Mg2+ concentration (mM).")
+	flag.StringVar(&a.PrimingParam.AffinityFile, "pa", "", "Export primer affinities.")
+	flag.StringVar(&a.PrimingParam.PrimerFile, "pc", "", "Primer concentration table.")
 	flag.Float64Var(&a.FixedEff, "e", 0.0, "Fixed per-cyle PCR efficiency.")
 	flag.StringVar(&gcEffParams, "eg", "", "GC efficiency parameters")
+	flag.StringVar(&gcModel, "gm", "", "GC efficiency model")
+	flag.IntVar(&a.GcWindow, "gw", 0, "GC window size")
 	flag.StringVar(&lenEffParams, "el", "(0.0,1.0,1.0)", "Length efficiency parameters")
 	flag.StringVar(&a.RawParamsFile, "j", "", "Raw parameter file generated by effest.")
 	flag.Float64Var(&a.MinRawGcEff, "jm", 0.0, "Minimum raw GC efficiency.")
@@ -117,11 +219,16 @@ func (a *CmdArgs) Parse() {
 	flag.Int64Var(&a.PcrSeed, "sp", 0, "PCR amplification random seed.")
 	flag.Int64Var(&a.SamplingSeed, "ss", 0, "Sampling random seed.")
 	flag.StringVar(&a.GobDir, "gobdir", "", "Directory to store gob files.")
+	flag.StringVar(&a.SaveCkpt, "cks", "", "Save the amplified pool.")
+	flag.StringVar(&a.LoadCkpt, "ckl", "", "Load the amplified pool.")
+	flag.BoolVar(&a.MmapStore, "gmm", false, "Memory map the fragment store.")
+	flag.StringVar(&maxMem, "max-mem", "", "Memory budget of the fragment tables.")
 	flag.IntVar(&a.GCFreq, "gcfreq", 100, "Force garbage collection after processing <gcfreq> transcripts.")
 	flag.StringVar(&a.ProfFile, "prof", "", "Write out CPU profiling information.")
 	flag.BoolVar(&help, "h", false, "Print out help message.")
 	flag.BoolVar(&version, "V", false, "Print out version.")
 	flag.BoolVar(&a.Verbose, "v", false, "Toggle verbose mode.")
+	flag.BoolVar(&a.Lineage, "lin", false, "Track source molecules of fragments.")
 	flag.BoolVar(&randtest, "randt", false, "Generate random numbers for testing.")
 
 	// Redefine usage:
@@ -136,30 +243,119 @@ Optional arguments:
         -d      fragment size distribution  string  "1.0:sn:(189, 24, -1.09975, 76, 294)" 
         -f      fragmentation method        string  "after_prim_double"
         -b      strand bias                 float   0.5
+        -lt     library type:               string  ""
+                unstranded, fr-firststrand (dUTP)
+                or fr-secondstrand, supersedes -b
+        -al     antisense leakage rate      float   0.0
+                (stranded library types only)
         -c      PCR cycles                  int     11
+        -ps     PCR substitution rate       float   0.0
+                (per base and duplication)
+        -pi     PCR indel rate              float   0.0
+                (per base and duplication)
+        -pch    PCR chimera rate            float   0.0
+                (per copy and cycle)
+        -pco    minimum homology overlap    int     15
+                of PCR chimeras
+        -pk     PCR plateau capacity        float   0.0
+                (total molecules, amplifies
+                the whole pool together)
+        -px     approximate PCR above this  int     0
+                count (0: exact)
+        -pxc    compare approximate and     bool    false
+                exact PCR in the report
+        -hf     hairpin penalty: none,      string  "none"
+                ends or whole fragment
+        -hw     folded end length           int     30
+        -hs     hairpin free energy scale   float   10.0
+                (kcal/mol per e-fold loss)
+        -hr     minimum homopolymer length  int     6
+        -hp     homopolymer penalty         float   0.0
+                (per base of long runs)
+        -hx     export per-fragment         string  ""
+                sequence feature penalties
         -p      priming bias parameter      float   5.0
         -k      primer length               int     6
+        -pmm    maximum primer mismatches   int     0
+        -pt     priming temperature (C)     float   -
+                supersedes -p
+        -nn     nearest-neighbour params:   string  "santalucia2004"
+                santalucia2004 (DNA/DNA),
+                sugimoto1995 (RNA/DNA) or file
+        -na     monovalent salt (mM)        float   1000.0
+        -mg     Mg2+ concentration (mM)     float   0.0
+        -pa     export primer affinities    string  ""
+        -pc     primer concentration table  string  ""
         -a      poly(A) tail size dist.     string  [check source]
+        -ac     poly(A) capture efficiency
+                as "(half, slope)"          string  ""
+        -ip     internal priming prob.      float   0.0
+        -ipl    minimum A-run length        int     12
+        -rr     rRNA fasta file             string  ""
+        -rrf    rRNA fraction of molecules  float   0.05
+        -rrd    rRNA depletion efficiency   float   0.0
+        -rrp    depletion probe model as
+                "(probe length, gap)"       string  ""
+        -gd     genome fasta file (gDNA)    string  ""
+        -gdf    gDNA fraction of molecules  float   0.01
+        -ch     chimera rate                float   0.0
+        -chm    microhomology bias (weight  float   1.0
+                per base at junctions)
+        -ad     adapters: truseq, nextera   string  "truseq"
+                or "read1,read2" sequences
+        -adr    adapter dimer rate          float   0.0
+        -sir    short insert rate           float   0.0
+        -rl     read length                 int     100
+        -fm     output full molecules       bool    false
+                including adapters
+        -um     UMI length or pattern of    string  ""
+                IUPAC codes (e.g. NNNNTNNNN)
+        -ue     UMI sequencing error rate   float   0.0
+        -uf     write UMIs as separate      string  ""
+                reads, otherwise appended
+                to the read names
         -flg    fragment loss probability   float   0.0
         -m      expression level multiplier float   1.0
         -e      fixed PCR efficiency        float   0.0
         -eg     GC efficiency parameters 
                 as "(shape, min, max)":     raw from SRR521457
+        -gm     GC efficiency model:        string  ""
+                "shape:(shape, min, max)",
+                "logistic:(mid, slope, min, max)",
+                "linear:(gc:eff, ...)" or
+                "spline:(gc:eff, ...)",
+                supersedes -eg and -j
+        -gw     GC window size (0: whole    int     0
+                fragment)
         -el     length efficiency parameters 
                 as "(shape, min, max)":
                     shape                   float   0.0
                     min                     float   1.0
                     max                     float   1.0
         -j      raw parameter file          string  
-                superseeds -d, -c, -eg
+                supersedes -d, -c, -eg
         -jm     minimum raw gc efficiency   float   0.0
         -r      report file                 string  "rlsim_report.json"
         -t      number of cores to use      int     4
         -g      keep fragments in memory    bool    false
+        -cks    save the amplified pool to  string  ""
+                a checkpoint file
+        -ckl    load the amplified pool     string  ""
+                from a checkpoint and only
+                sample fragments
+        -lin    track source molecules and  bool    false
+                pre-PCR fragments
         -si     initial random seed         int     from UTC time
         -sp     pcr random seed             int     auto
         -ss     sampling random seed        int     auto
-        -gobdir fragment directory          string  "rlsim_gob_$PID"
+        -gobdir fragment store directory    string  "rlsim_gob_$PID"
+        -gmm    memory map the fragment     bool    false
+                store
+        -max-mem
+                memory budget of fragment   string  ""
+                tables (e.g. 2G), idle
+                tables are spilled to the
+                store only above it
         -v      toggle verbose mode         bool    false
         -h      print usage and exit        bool    false
         -V      print version and exit      bool    false
@@ -179,6 +375,12 @@ For more details consult the package manual at:
 	}
 
 	flag.Parse()
+	// Check for flags without a neutral default:
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "pt" {
+			a.PrimingParam.Celsius = true
+		}
+	})
 	// Print usage:
 	if help {
 		flag.Usage()
@@ -208,7 +410,18 @@ For more details consult the package manual at:
 		flag.Usage()
 		L.Fatal("Invalid primer length!")
 	}
-	a.KmerLength = uint32(kmerLenght)
+	a.PrimingParam.KmerLength = uint32(kmerLenght)
+
+	// Check the number of tolerated primer mismatches:
+	if maxMismatch < 0 || maxMismatch > kmerLenght {
+		L.Fatalf("The maximum number of primer mismatches must be in the interval [0, %d]!", kmerLenght)
+	}
+	a.PrimingParam.MaxMismatch = maxMismatch
+
+	// Check salt concentrations:
+	if a.PrimingParam.Na < 0 || a.PrimingParam.Mg < 0 {
+		L.Fatalf("Salt concentrations must not be negative!")
+	}
 
 	// Check frgament loss probability:
 	if a.FragLossProb < 0.0 || a.FragLossProb > 1 {
@@ -230,11 +443,24 @@ For more details consult the package manual at:
 		L.Fatal("Illegal fragment number!")
 	}
 
+	// Check the approximate PCR threshold:
+	if a.PcrApprox < 0 {
+		L.Fatal("Illegal approximate PCR threshold!")
+	}
+
 	// Parse target mixture string:
 	a.TargetMix = parseTargetMixString(targMix)
 	// Parse fragmentation method string:
 	a.FragMethod = parseFragMethodString(fragMethod)
 
+	// Parse memory budget:
+	if maxMem != "" {
+		a.MaxMem = parseByteSize(maxMem)
+		if gob {
+			L.Fatal("The -g and -max-mem options are mutually exclusive!")
+		}
+	}
+
 	// Set gob directory
 	if !gob && a.GobDir == "" {
 		a.GobDir = "rlsim_gob_" + fmt.Sprintf("%d", os.Getpid())
@@ -252,10 +478,22 @@ For more details consult the package manual at:
 		a.NrCycles = rp.NrCycles
 		a.RawLenProbs = &rp.TargetProbs
 		a.RawGcEffs = rp.GcEffs
+		if gcModel == "" {
+			gcModel = rp.GcModel
+		}
+		if a.GcWindow == 0 {
+			a.GcWindow = rp.GcWindow
+		}
+		a.EffSurface = rp.GcLenEffs
+	}
+
+	// Parse GC efficiency model, supersedes -eg and the raw GC efficiencies:
+	if gcModel != "" {
+		a.GcModel = ParseGcModelString(gcModel)
 	}
 
 	// Warn about using default raw GC efficiencies:
-	if defaultRawGcFlag && (a.ReqFrags > 0) && a.RawParamsFile == "" {
+	if defaultRawGcFlag && (a.ReqFrags > 0) && a.RawParamsFile == "" && a.GcModel == nil {
 		L.Println("WARNING: Using raw efficiencies estimated from SRR521457 by default")
 		L.Println("(see http://bit.ly/rlsim-pl and http://bit.ly/rlsim-pa for the details).")
 	}
@@ -306,6 +544,30 @@ func parseFragMethodString(s string) *FragMethod {
 	return fm
 }
 
+// Parse a size in bytes with an optional K, M, G or T suffix:
+func parseByteSize(s string) int64 {
+	mul := int64(1)
+	num := strings.ToUpper(s)
+	switch {
+	case strings.HasSuffix(num, "K"):
+		mul = 1 << 10
+	case strings.HasSuffix(num, "M"):
+		mul = 1 << 20
+	case strings.HasSuffix(num, "G"):
+		mul = 1 << 30
+	case strings.HasSuffix(num, "T"):
+		mul = 1 << 40
+	}
+	if mul > 1 {
+		num = num[:len(num)-1]
+	}
+	size, err := strconv.ParseFloat(num, 64)
+	if err != nil || size <= 0 {
+		L.Fatal("Malformed memory budget: " + s)
+	}
+	return int64(size * float64(mul))
+}
+
 // Parse efficiency parameter string:
 func ParseEffParamString(s string) *EffParam {
 	p := new(EffParam)
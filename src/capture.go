@@ -0,0 +1,130 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Oligo-dT capture of poly(A) molecules:
+type PolyACapture struct {
+	Logistic     bool    // Capture efficiency depends on the tail length.
+	Half         float64 // Tail length captured with probability 0.5.
+	Slope        float64 // Steepness of the logistic curve.
+	InternalProb float64 // Probability of internal priming at an A-run.
+	MinRun       uint32  // Minimum length of A-runs supporting internal priming.
+}
+
+func NewPolyACapture(s string, internalProb float64, minRun int) *PolyACapture {
+	c := new(PolyACapture)
+	if s != "" {
+		c.Logistic = true
+		c.Half, c.Slope = parseCaptureString(s)
+		L.PrintfV("Poly(A) capture efficiency parameters: (%g, %g)", c.Half, c.Slope)
+	}
+	if internalProb < 0.0 || internalProb > 1.0 {
+		L.Fatalf("The internal priming probability must be in the interval [0, 1]!")
+	}
+	if minRun < 1 {
+		L.Fatalf("The minimum A-run length for internal priming must be positive!")
+	}
+	c.InternalProb = internalProb
+	c.MinRun = uint32(minRun)
+	if c.InternalProb > 0.0 {
+		L.PrintfV("Internal priming probability at A-runs of at least %d bases: %g", c.MinRun, c.InternalProb)
+	}
+	return c
+}
+
+// Parse a capture parameter string formatted as "(half, slope)":
+func parseCaptureString(s string) (half float64, slope float64) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
+		L.Fatal("Missing paranthesis in capture parameter string: " + s)
+	}
+	s = s[1 : len(s)-1]
+	n, e := fmt.Sscanf(s, "%f,%f", &half, &slope)
+	if n != 2 || e != nil {
+		L.Fatal("Failed to parse capture parameter string: " + s)
+	}
+	if half < 0 || slope < 0 {
+		L.Fatalf("Capture parameters must not be negative!")
+	}
+	return
+}
+
+// Is any of the capture effects simulated?
+func (c PolyACapture) Active() bool {
+	return c.Logistic || c.InternalProb > 0.0
+}
+
+// Probability of capturing a molecule with a given tail length:
+func (c PolyACapture) CaptureProb(tailLen uint32) float64 {
+	if !c.Logistic {
+		return 1.0
+	}
+	return 1.0 / (1.0 + math.Exp(-c.Slope*(float64(tailLen)-c.Half)))
+}
+
+// Find the A-runs (stretches of adenines) supporting internal priming in a sequence:
+func (c PolyACapture) FindARuns(seq string) []Interval {
+	runs := make([]Interval, 0)
+	if c.InternalProb == 0.0 {
+		return runs
+	}
+	var start int
+	for i := 0; i <= len(seq); i++ {
+		if i < len(seq) && seq[i] == 'A' {
+			continue
+		}
+		if uint32(i-start) >= c.MinRun {
+			runs = append(runs, Interval{uint32(start), uint32(i)})
+		}
+		start = i + 1
+	}
+	return runs
+}
+
+// Simulate the capture of a molecule ending at polyAend. Returns the end of the
+// captured (possibly truncated) molecule and false if the molecule is lost.
+func (c PolyACapture) Capture(runs []Interval, polyAend int, tailLen uint32, st FragStater, rand Rander) (int, bool) {
+	// Internal priming, starting from the 3' end:
+	for i := len(runs) - 1; i >= 0; i-- {
+		if rand.Float64() < c.InternalProb {
+			st.UpdateInternalPriming(uint32(polyAend) - runs[i].End)
+			return int(runs[i].End), true
+		}
+	}
+	// Capture by the poly(A) tail:
+	captured := rand.Float64() < c.CaptureProb(tailLen)
+	st.UpdateCapture(tailLen, captured)
+	return polyAend, captured
+}
@@ -0,0 +1,215 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Flags which do not influence the amplified pool:
+var downstreamFlags = map[string]bool{
+	"n": true, "ss": true, "b": true, "lt": true, "al": true, "ch": true, "chm": true,
+	"ad": true, "adr": true, "sir": true, "rl": true, "fm": true, "ue": true, "uf": true,
+	"r": true, "t": true, "g": true, "gobdir": true, "gmm": true, "max-mem": true, "gcfreq": true, "prof": true,
+	"h": true, "V": true, "v": true, "randt": true, "pxc": true, "hx": true, "pa": true,
+	"cks": true, "ckl": true,
+}
+
+const checkpointVersion = 3
+
+type checkpointHeader struct {
+	Version        int
+	Hash           string
+	NrTranscripts  int
+	MaxTranscripts uint64 // Next free transcript id.
+}
+
+type transcriptCheckpoint struct {
+	Id        uint64
+	Name      string
+	Seq       string // Plus strand without the poly(A) tail.
+	PolyA     uint32 // Length of the maximal poly(A) tail.
+	ExprLevel uint64
+	Origin    string
+	Variants  []FragVariant // The first element is a placeholder for fragments without variants.
+	Frags     map[uint32]StartEndCountStruct
+}
+
+// Transcripts having fragments of a given length in the pool, referred by their ids:
+type trCountCheckpoint struct {
+	Ids   []uint64
+	Count []uint64
+}
+
+// Hash of the parameters determining the amplified pool. Files given as
+// parameters or input are identified by their path, size and modification time:
+func UpstreamHash(args *CmdArgs) string {
+	h := sha256.New()
+	file := func(name string) {
+		if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() {
+			fmt.Fprintf(h, "[%d %d]", fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if downstreamFlags[f.Name] {
+			return
+		}
+		v := f.Value.String()
+		fmt.Fprintf(h, "-%s=%q", f.Name, v)
+		file(v)
+	})
+	for _, in := range args.InputFiles {
+		fmt.Fprintf(h, "<%q>", in)
+		file(in)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Save the amplified pool, the fragment tables and the statistics:
+func (p Pool) SaveCheckpoint(file string, hash string, st FragStater) {
+	f, err := os.Create(file)
+	if err != nil {
+		L.Fatalf("Could not create checkpoint file \"%s\": %s", file, err.Error())
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+	w, _ := flate.NewWriter(bw, flate.BestSpeed)
+	enc := gob.NewEncoder(w)
+	encode := func(v interface{}) {
+		if err := enc.Encode(v); err != nil {
+			L.Fatalf("Failed to write checkpoint \"%s\": %s", file, err.Error())
+		}
+	}
+
+	encode(checkpointHeader{checkpointVersion, hash, p.GetNrTranscripts(), maxTranscriptId})
+	for _, t := range p.GetTranscripts() {
+		tr := t.(*Transcript)
+		tr.Ungob()
+		tc := transcriptCheckpoint{Id: tr.id, Name: tr.name, Seq: tr.seq.Sub(0, tr.len-tr.seq.Tail()), PolyA: tr.seq.Tail(), ExprLevel: tr.exprLevel, Origin: tr.origin}
+		tc.Variants = variantValues(*tr.Variants)
+		tc.Frags = *tr.FragStructs
+		encode(tc)
+		tr.Gob()
+	}
+
+	lengths := make(map[uint32]trCountCheckpoint, len(p.LenTrCountStructs))
+	for length, trc := range p.LenTrCountStructs {
+		c := trCountCheckpoint{make([]uint64, len(trc.tr)), trc.count}
+		for i, tr := range trc.tr {
+			c.Ids[i] = tr.GetId()
+		}
+		lengths[length] = c
+	}
+	encode(lengths)
+	encode(st.(*FragStats))
+
+	w.Close()
+	bw.Flush()
+	L.PrintfV("Checkpoint written to %s.", file)
+}
+
+// Open a checkpoint and validate its header:
+func openCheckpoint(file string, hash string) (*os.File, *gob.Decoder, checkpointHeader) {
+	f, err := os.Open(file)
+	if err != nil {
+		L.Fatalf("Could not open checkpoint file \"%s\": %s", file, err.Error())
+	}
+	dec := gob.NewDecoder(flate.NewReader(bufio.NewReader(f)))
+	var head checkpointHeader
+	if err := dec.Decode(&head); err != nil {
+		L.Fatalf("Failed to read checkpoint \"%s\": %s", file, err.Error())
+	}
+	if head.Version != checkpointVersion {
+		L.Fatalf("Unsupported checkpoint version: %d", head.Version)
+	}
+	if head.Hash != hash {
+		L.Fatalf("The checkpoint \"%s\" was created with different upstream parameters or input files!", file)
+	}
+	return f, dec, head
+}
+
+// Check that a checkpoint can be loaded before creating the fragment store:
+func CheckCheckpoint(file string, hash string) {
+	f, _, _ := openCheckpoint(file, hash)
+	f.Close()
+}
+
+// Restore the amplified pool saved by SaveCheckpoint, returns the statistics:
+func (p Pool) LoadCheckpoint(file string, hash string) FragStater {
+	f, dec, head := openCheckpoint(file, hash)
+	defer f.Close()
+	decode := func(v interface{}) {
+		if err := dec.Decode(v); err != nil {
+			// Remove the partially filled store:
+			p.Cleanup()
+			L.Fatalf("Failed to read checkpoint \"%s\": %s", file, err.Error())
+		}
+	}
+
+	byId := make(map[uint64]Transcripter, head.NrTranscripts)
+	for i := 0; i < head.NrTranscripts; i++ {
+		var tc transcriptCheckpoint
+		decode(&tc)
+		tr := NewTranscript(tc.Name, tc.Seq, tc.ExprLevel, int(tc.PolyA), p.Store)
+		tr.id = tc.Id
+		tr.origin = tc.Origin
+		*tr.Variants = variantPointers(tc.Variants)
+		*tr.FragMap = nil
+		*tr.varIndex = nil
+		*tr.FragStructs = tc.Frags
+		if *tr.FragStructs == nil {
+			*tr.FragStructs = make(map[uint32]StartEndCountStruct)
+		}
+		tr.Gob()
+		p.AddTranscript(tr)
+		byId[tr.id] = tr
+	}
+	maxTranscriptId = head.MaxTranscripts
+
+	var lengths map[uint32]trCountCheckpoint
+	decode(&lengths)
+	for length, c := range lengths {
+		trc := &TrCountStruct{make([]Transcripter, len(c.Ids)), c.Count}
+		for i, id := range c.Ids {
+			trc.tr[i] = byId[id]
+		}
+		p.LenTrCountStructs[length] = trc
+	}
+
+	st := NewFragStats()
+	decode(st)
+	L.PrintfV("Loaded %d transcripts from checkpoint %s.", head.NrTranscripts, file)
+	return st
+}
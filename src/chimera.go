@@ -0,0 +1,242 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Maximum length of microhomology considered at chimeric junctions:
+const maxMicrohomology = 8
+
+// Minimum length of a chimera part:
+const minChimPart = 20
+
+// Minimum size of the sample of potential chimera partners:
+const chimPartnerPool = 1000
+
+// Number of attempts to find a partner from another transcript:
+const chimPartnerTries = 10
+
+// Simulate intermolecular chimeras formed during ligation or by template
+// switching. A chimeric insert keeps the length of the original fragment,
+// its 3' part is replaced by the 3' part of a fragment from another transcript.
+// The fragments are sampled transcript by transcript, so the chimeras are only
+// joined at the end, with partners drawn from a uniform sample of the whole pool.
+type Chimerizer struct {
+	Rate     float64
+	MhBias   float64
+	size     int         // Size of the partner sample.
+	partners *[]Fragment // Reservoir sample of the fragments not turned into chimeras.
+	seen     *int64      // Number of fragments offered to the sample.
+	pending  *[]Fragment // Fragments waiting for a partner.
+}
+
+func NewChimerizer(rate float64, mhBias float64, reqFrags int64) *Chimerizer {
+	if rate < 0.0 || rate > 1.0 {
+		L.Fatalf("The chimera rate must be in the interval [0, 1]!")
+	}
+	if mhBias < 1.0 {
+		L.Fatalf("The microhomology bias must be at least 1.0!")
+	}
+	ch := &Chimerizer{Rate: rate, MhBias: mhBias}
+	// Leave room for twice the expected number of chimeras, as every partner is used once:
+	ch.size = chimPartnerPool + int(2.0*rate*float64(reqFrags))
+	partners := make([]Fragment, 0)
+	ch.partners = &partners
+	ch.seen = new(int64)
+	pending := make([]Fragment, 0)
+	ch.pending = &pending
+	if rate > 0.0 {
+		L.PrintfV("Chimera rate: %g, microhomology bias: %g", rate, mhBias)
+	}
+	return ch
+}
+
+// Turn the fragment into a chimera with probability given by the rate. Chimeras
+// are held back until Flush, the other fragments are returned for output and
+// offered to the sample of partners.
+func (ch Chimerizer) Process(f Fragment, rand Rander) []Fragment {
+	if ch.Rate == 0.0 {
+		return []Fragment{f}
+	}
+	if rand.Float64() < ch.Rate {
+		*ch.pending = append(*ch.pending, f)
+		return nil
+	}
+	ch.addPartner(f, rand)
+	return []Fragment{f}
+}
+
+// Join every held back fragment with its own partner drawn from the sample, using
+// every partner at most once. Fragments without a suitable partner are returned as
+// they are:
+func (ch Chimerizer) Flush(st FragStater, rand Rander) []Fragment {
+	partners := *ch.partners
+	out := make([]Fragment, 0, len(*ch.pending))
+PENDING:
+	for _, p := range *ch.pending {
+		for i := 0; i < chimPartnerTries && len(partners) > 0; i++ {
+			j := rand.Int63n(int64(len(partners)))
+			partner := partners[j]
+			if partner.GetName() == p.GetName() {
+				continue
+			}
+			if cf, ok := NewChimFrag(p, partner, ch.MhBias, rand); ok {
+				partners[j] = partners[len(partners)-1]
+				partners = partners[:len(partners)-1]
+				st.UpdateChimera(cf.Microhomology)
+				out = append(out, cf)
+				continue PENDING
+			}
+		}
+		out = append(out, p)
+	}
+	*ch.pending = nil
+	*ch.partners = nil
+	return out
+}
+
+// Offer a fragment to the sample of partners (reservoir sampling):
+func (ch Chimerizer) addPartner(f Fragment, rand Rander) {
+	*ch.seen++
+	if len(*ch.partners) < ch.size {
+		*ch.partners = append(*ch.partners, f)
+		return
+	}
+	if j := rand.Int63n(*ch.seen); j < int64(ch.size) {
+		(*ch.partners)[j] = f
+	}
+}
+
+// Chimeric fragment: the first part comes from the first parent, the rest from the second.
+type ChimFrag struct {
+	Fragment
+	partner       Fragment
+	junction      uint32 // Length of the first part.
+	Microhomology uint32
+}
+
+// Join the fragments, sampling the junction with a bias towards microhomology:
+func NewChimFrag(a Fragment, b Fragment, mhBias float64, rand Rander) (*ChimFrag, bool) {
+	seqA, seqB := a.GetSeq(), b.GetSeq()
+	lenA, lenB := len(seqA), len(seqB)
+	// The junction must leave at least minChimPart bases from both parents:
+	low := minChimPart
+	if lenA-lenB > low {
+		low = lenA - lenB
+	}
+	high := lenA - minChimPart
+	if high < low {
+		return nil, false
+	}
+	w := make([]float64, high-low+1)
+	mh := make([]uint32, high-low+1)
+	for j := low; j <= high; j++ {
+		mh[j-low] = microhomology(seqA[:j], seqB[:lenB-(lenA-j)])
+		w[j-low] = math.Pow(mhBias, float64(mh[j-low]))
+	}
+	i, ok := rand.SampleIndexFloat64(w)
+	if !ok {
+		return nil, false
+	}
+	return &ChimFrag{Fragment: a, partner: b, junction: uint32(low) + uint32(i), Microhomology: mh[i]}, true
+}
+
+// Length of the common suffix of two sequences:
+func microhomology(a string, b string) uint32 {
+	var h uint32
+	for h < maxMicrohomology && int(h) < len(a) && int(h) < len(b) && a[len(a)-1-int(h)] == b[len(b)-1-int(h)] {
+		h++
+	}
+	return h
+}
+
+func (cf ChimFrag) GetSeq() string {
+	seqA, seqB := cf.Fragment.GetSeq(), cf.partner.GetSeq()
+	rest := len(seqA) - int(cf.junction)
+	return seqA[:cf.junction] + seqB[len(seqB)-rest:]
+}
+
+func (cf ChimFrag) IsChimera() bool {
+	return true
+}
+
+func (cf ChimFrag) SetId(id uint64) Fragment {
+	cf.Fragment = cf.Fragment.SetId(id)
+	return cf
+}
+
+func (cf ChimFrag) SetStrand(strand string) Fragment {
+	cf.Fragment = cf.Fragment.SetStrand(strand)
+	return cf
+}
+
+func (cf ChimFrag) SetRNAStrand(strand string) Fragment {
+	cf.Fragment = cf.Fragment.SetRNAStrand(strand)
+	return cf
+}
+
+// Plus strand coordinates of the first bases of a fragment in read orientation.
+// Indels make the sequence length differ from the span, so n is capped by the span:
+func headCoords(f Fragment, n uint32) (uint32, uint32) {
+	if span := f.GetEnd() - f.GetStart(); n > span {
+		n = span
+	}
+	if f.GetStrand() == "+" {
+		return f.GetStart(), f.GetStart() + n
+	}
+	return f.GetEnd() - n, f.GetEnd()
+}
+
+// Plus strand coordinates of the last bases of a fragment in read orientation:
+func tailCoords(f Fragment, n uint32) (uint32, uint32) {
+	if span := f.GetEnd() - f.GetStart(); n > span {
+		n = span
+	}
+	if f.GetStrand() == "+" {
+		return f.GetEnd() - n, f.GetEnd()
+	}
+	return f.GetStart(), f.GetStart() + n
+}
+
+func (cf ChimFrag) String() string {
+	a := cf.Fragment
+	b := cf.partner
+	// Length of the second part, split the same way as in NewChimFrag:
+	rest := uint32(len(a.GetSeq())) - cf.junction
+	as, ae := headCoords(a, cf.junction)
+	bs, be := tailCoords(b, rest)
+	s := fmt.Sprintf(">Fg_%d_%s (Strand %s Offset %d -- %d)", a.GetId(), a.GetName(), a.GetStrand(), as, ae)
+	s += a.GetTags()
+	s += fmt.Sprintf(" Chimera=%s:%s:%d-%d Junction=%d Microhomology=%d", b.GetName(), b.GetStrand(), bs, be, cf.junction, cf.Microhomology)
+	s += "\n" + cf.GetSeq()
+	return s
+}
@@ -0,0 +1,243 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Origins of simulated molecules:
+const (
+	OriginMRNA = "mRNA"
+	OriginRRNA = "rRNA"
+	OriginGDNA = "gDNA"
+)
+
+// Genomic DNA is split into chunks of this size:
+const gdnaChunkSize = 10000
+
+// A source of contaminating molecules appended to the input transcriptome:
+type ContamSource struct {
+	Origin    string
+	File      string
+	Fraction  float64 // Fraction of total molecules before depletion.
+	Depletion *Depletion
+	Chunked   bool   // Molecules are distributed uniformly over chunks of the sequences.
+	rand      Rander // Used when distributing molecules over chunks.
+}
+
+func NewContamSource(origin string, file string, fraction float64, depletion *Depletion) *ContamSource {
+	if fraction < 0.0 || fraction >= 1.0 {
+		L.Fatalf("The %s fraction must be in the interval [0, 1)!", origin)
+	}
+	L.PrintfV("Contaminating %s from %s with fraction %g.", origin, file, fraction)
+	return &ContamSource{Origin: origin, File: file, Fraction: fraction, Depletion: depletion}
+}
+
+// Source of genomic DNA molecules, uniformly distributed over the genome:
+func NewGenomicSource(file string, fraction float64, rand Rander) *ContamSource {
+	cs := NewContamSource(OriginGDNA, file, fraction, nil)
+	cs.Chunked = true
+	cs.rand = rand
+	return cs
+}
+
+// Number of contaminating molecules given the number of transcriptome molecules:
+func (cs ContamSource) NrMolecules(total uint64) uint64 {
+	return uint64(float64(total)*cs.Fraction/(1.0-cs.Fraction) + 0.5)
+}
+
+// Send the contaminating molecules to the transcript channel:
+func (cs ContamSource) Emit(total uint64, store *FragStore, c chan *Transcript) {
+	if cs.Chunked {
+		cs.emitChunks(total, store, c)
+		return
+	}
+	for _, tr := range cs.Transcripts(total, store) {
+		c <- tr
+	}
+}
+
+// Read the contaminating sequences and distribute molecules among them. The
+// sequence names can carry relative abundances using the "name$level" syntax,
+// otherwise the sequences are equally abundant.
+func (cs ContamSource) Transcripts(total uint64, store *FragStore) []*Transcript {
+	sr := NewFastaToSeq(OpenFasta(cs.File))
+	seqs := make([]*Seq, 0)
+	weights := make([]float64, 0)
+	var sum float64
+	for seq := sr.NextSeq(); seq != nil; seq = sr.NextSeq() {
+		w := 1.0
+		if spl := strings.Split(seq.Name, "$"); len(spl) == 2 {
+			if _, err := fmt.Sscanf(strings.TrimSpace(spl[1]), "%g", &w); err != nil || w < 0 {
+				L.Fatalf("Malformed %s sequence name: %s", cs.Origin, seq.Name)
+			}
+			seq.Name = spl[0]
+		}
+		seqs = append(seqs, seq)
+		weights = append(weights, w)
+		sum += w
+	}
+	if len(seqs) == 0 || sum == 0.0 {
+		L.Fatalf("No %s sequences found in %s!", cs.Origin, cs.File)
+	}
+
+	nrMols := cs.NrMolecules(total)
+	L.PrintfV("Number of %s molecules: %d", cs.Origin, nrMols)
+	trs := make([]*Transcript, len(seqs))
+	for i, seq := range seqs {
+		level := uint64(float64(nrMols)*weights[i]/sum + 0.5)
+		tr := NewTranscript(seq.Name, seq.Seq, level, 0, store)
+		tr.origin = cs.Origin
+		tr.depletion = cs.Depletion
+		trs[i] = tr
+	}
+	return trs
+}
+
+// Distribute molecules uniformly over the chunks of the sequences. The first
+// pass calculates the total length, the second pass emits the chunks having
+// at least one molecule.
+func (cs ContamSource) emitChunks(total uint64, store *FragStore, c chan *Transcript) {
+	var remLen uint64
+	sr := NewFastaToSeq(OpenFasta(cs.File))
+	for seq := sr.NextSeq(); seq != nil; seq = sr.NextSeq() {
+		remLen += uint64(len(seq.Seq))
+	}
+	if remLen == 0 {
+		L.Fatalf("No %s sequences found in %s!", cs.Origin, cs.File)
+	}
+
+	remMols := cs.NrMolecules(total)
+	L.PrintfV("Number of %s molecules: %d", cs.Origin, remMols)
+	var nrChunks int
+	sr = NewFastaToSeq(OpenFasta(cs.File))
+	for seq := sr.NextSeq(); seq != nil && remMols > 0; seq = sr.NextSeq() {
+		name := strings.Fields(seq.Name)[0]
+		for start := 0; start < len(seq.Seq); start += gdnaChunkSize {
+			end := start + gdnaChunkSize
+			if end > len(seq.Seq) {
+				end = len(seq.Seq)
+			}
+			// Sample the number of molecules conditional on the remaining ones:
+			var level uint64
+			if uint64(end-start) >= remLen {
+				level = remMols
+			} else {
+				level = cs.rand.Binomial(remMols, float64(end-start)/float64(remLen))
+			}
+			remLen -= uint64(end - start)
+			remMols -= level
+			chunk := seq.Seq[start:end]
+			if level == 0 || strings.Trim(chunk, "N") == "" {
+				continue
+			}
+			tr := NewTranscript(fmt.Sprintf("%s:%d-%d", name, start+1, end), chunk, level, 0, store)
+			tr.origin = cs.Origin
+			c <- tr
+			nrChunks++
+		}
+	}
+	L.PrintfV("Number of %s chunks: %d", cs.Origin, nrChunks)
+}
+
+// Removal of contaminating molecules by hybridisation to probes. Without
+// a probe model whole molecules are removed, otherwise the probe covered
+// regions are digested, leaving the gaps between the probes intact.
+type Depletion struct {
+	Efficiency float64
+	Probes     bool
+	ProbeLen   uint32
+	GapLen     uint32
+}
+
+func NewDepletion(efficiency float64, probeModel string) *Depletion {
+	if efficiency < 0.0 || efficiency > 1.0 {
+		L.Fatalf("The depletion efficiency must be in the interval [0, 1]!")
+	}
+	d := &Depletion{Efficiency: efficiency}
+	if probeModel != "" {
+		d.Probes = true
+		d.ProbeLen, d.GapLen = parseProbeString(probeModel)
+		L.PrintfV("Depletion probes of length %d with gaps of %d bases.", d.ProbeLen, d.GapLen)
+	}
+	L.PrintfV("Depletion efficiency: %g", efficiency)
+	return d
+}
+
+// Parse a probe model string formatted as "(probe length, gap length)":
+func parseProbeString(s string) (probeLen uint32, gapLen uint32) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
+		L.Fatal("Missing paranthesis in probe model string: " + s)
+	}
+	s = s[1 : len(s)-1]
+	n, e := fmt.Sscanf(s, "%d,%d", &probeLen, &gapLen)
+	if n != 2 || e != nil || probeLen == 0 {
+		L.Fatal("Failed to parse probe model string: " + s)
+	}
+	return
+}
+
+// Simulate the depletion of a molecule of given length. Returns false if the
+// whole molecule is removed, otherwise the digested regions are stored in
+// digested.
+func (d Depletion) Deplete(length uint32, digested *[]Interval, rand Rander) bool {
+	*digested = (*digested)[:0]
+	if !d.Probes {
+		return rand.Float64() >= d.Efficiency
+	}
+	for start := uint32(0); start < length; start += d.ProbeLen + d.GapLen {
+		if rand.Float64() < d.Efficiency {
+			end := start + d.ProbeLen
+			if end > length {
+				end = length
+			}
+			*digested = append(*digested, Interval{start, end})
+		}
+	}
+	return true
+}
+
+// Half-open interval of transcript coordinates:
+type Interval struct {
+	Start uint32
+	End   uint32
+}
+
+// Does a fragment overlap any of the intervals?
+func Overlaps(ivs []Interval, start uint32, end uint32) bool {
+	for _, iv := range ivs {
+		if start < iv.End && end > iv.Start {
+			return true
+		}
+	}
+	return false
+}
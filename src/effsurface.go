@@ -0,0 +1,121 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Joint GC content and length efficiency table, interpolated bilinearly:
+type EffSurface struct {
+	Gc     []float64   // GC content grid (fractions).
+	Length []float64   // Length grid.
+	Table  [][]float64 // Efficiencies by length and GC content.
+}
+
+func NewEffSurface(gc []float64, length []float64, eff [][]float64) *EffSurface {
+	if len(gc) < 1 || len(length) < 1 {
+		L.Fatalf("The efficiency surface must have at least one GC and one length bin!")
+	}
+	if !sort.Float64sAreSorted(gc) || !sort.Float64sAreSorted(length) {
+		L.Fatalf("The GC and length bins of the efficiency surface must be sorted!")
+	}
+	if len(eff) != len(length) {
+		L.Fatalf("The efficiency surface must have a row for every length bin!")
+	}
+	for _, row := range eff {
+		if len(row) != len(gc) {
+			L.Fatalf("The efficiency surface must have a column for every GC bin!")
+		}
+		for _, e := range row {
+			checkEffRange(e)
+		}
+	}
+	return &EffSurface{gc, length, eff}
+}
+
+// Position of x in a grid as an index and a weight of the next grid point,
+// the surface is constant outside the grid:
+func gridPos(grid []float64, x float64) (int, float64) {
+	n := len(grid)
+	if x <= grid[0] {
+		return 0, 0.0
+	}
+	if x >= grid[n-1] {
+		return n - 1, 0.0
+	}
+	i := sort.SearchFloat64s(grid, x) - 1
+	return i, (x - grid[i]) / (grid[i+1] - grid[i])
+}
+
+func (s EffSurface) Eff(gc float64, length uint32) float64 {
+	i, u := gridPos(s.Length, float64(length))
+	j, v := gridPos(s.Gc, gc)
+	e := s.Table[i][j] * (1.0 - u) * (1.0 - v)
+	if v > 0.0 {
+		e += s.Table[i][j+1] * (1.0 - u) * v
+	}
+	if u > 0.0 {
+		e += s.Table[i+1][j] * u * (1.0 - v)
+		if v > 0.0 {
+			e += s.Table[i+1][j+1] * u * v
+		}
+	}
+	return e
+}
+
+// The efficiency is limited by the most extreme GC window:
+func (s EffSurface) RangeEff(lo float64, hi float64, length uint32) float64 {
+	return math.Min(s.Eff(lo, length), s.Eff(hi, length))
+}
+
+// Report the surface over the range of target lengths:
+func (s EffSurface) Report(tg Targeter, rep Reporter) {
+	low, high := uint32(tg.GetLow()), uint32(tg.GetHigh())
+	step := (high - low) / 100
+	if step < 1 {
+		step = 1
+	}
+	gc := make([]float64, 101)
+	for j := range gc {
+		gc[j] = float64(j)
+	}
+	lengths := make([]uint32, 0)
+	z := make([][]float64, 0)
+	for l := low; l <= high; l += step {
+		row := make([]float64, len(gc))
+		for j := range gc {
+			row[j] = s.Eff(gc[j]/100.0, l)
+		}
+		lengths = append(lengths, l)
+		z = append(z, row)
+	}
+	rep.ReportMatrix(gc, lengths, z, "GC content (%)", "Length", "Joint efficiency surface", "matrix")
+}
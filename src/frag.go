@@ -37,18 +37,29 @@ type Fragment interface {
 	GetSeq() string
 	GetStrand() string
 	SetStrand(strand string) Fragment
+	GetRNAStrand() string
+	SetRNAStrand(strand string) Fragment
 	GetId() uint64
 	SetId(id uint64) Fragment
 	GetTranscript() Transcripter
+	GetReadStartMismatches() []int
+	GetLineage() *Lineage
+	GetPcrErrors() []SeqEdit
+	GetUmi() *UmiTag
+	GetOrigin() string
+	GetTags() string
+	IsChimera() bool
 	String() string
 }
 
 type Frag struct {
-	start  uint32
-	end    uint32
-	strand string
-	id     uint64
-	tr     Transcripter
+	start     uint32
+	end       uint32
+	strand    string
+	rnaStrand string // Strand of the originating molecule, empty if not recorded.
+	id        uint64
+	tr        Transcripter
+	variant   *FragVariant
 }
 
 func NewFrag(tr Transcripter, start uint32, end uint32) (f *Frag) {
@@ -75,17 +86,19 @@ func (f Frag) GetSeq() string {
 
 	start := f.GetStart()
 	end := f.GetEnd()
-	// Maximal coordinate:
-	final := f.tr.GetLen() - 1
-	var seq string
+	// Apply variant to the plus strand sequence:
+	if f.variant != nil {
+		seq := f.variant.Apply(f.variant.Template(f.tr, start, end))
+		if f.strand == "-" {
+			seq = RevCompDNA(seq)
+		}
+		return seq
+	}
+
 	if f.strand == "+" {
-		seq = f.tr.GetSeq()
-	} else {
-		seq = f.tr.GetRevSeq()
-		// Transform coordinate system:
-		start, end = (final - end + 1), (final - start + 1)
+		return f.tr.SubSeq(start, end)
 	}
-	return seq[start:end]
+	return f.tr.RevSubSeq(start, end)
 }
 
 func (f Frag) GetStrand() string {
@@ -100,6 +113,21 @@ func (f Frag) SetStrand(strand string) Fragment {
 	return f
 }
 
+func (f Frag) GetRNAStrand() string {
+	if f.rnaStrand == "" {
+		return "+"
+	}
+	return f.rnaStrand
+}
+
+func (f Frag) SetRNAStrand(strand string) Fragment {
+	if strand != "+" && strand != "-" {
+		L.Fatal("Invalid RNA strand!")
+	}
+	f.rnaStrand = strand
+	return f
+}
+
 func (f Frag) GetId() uint64 {
 	return f.id
 }
@@ -113,6 +141,51 @@ func (f Frag) GetTranscript() Transcripter {
 	return f.tr
 }
 
+// Positions of primer mismatches at the start of the first read:
+func (f Frag) GetReadStartMismatches() []int {
+	if f.variant == nil || f.tr == nil {
+		return nil
+	}
+	if f.strand == "+" {
+		site := f.variant.StartSite
+		return SiteMismatches(site, f.tr.SubSeq(f.start, f.start+uint32(len(site))))
+	}
+	site := RevCompDNA(f.variant.EndSite)
+	return SiteMismatches(site, f.tr.RevSubSeq(f.end-uint32(len(site)), f.end))
+}
+
+// Source molecule and pre-PCR fragment, nil if not tracked:
+func (f Frag) GetLineage() *Lineage {
+	if f.variant == nil {
+		return nil
+	}
+	return f.variant.Lineage
+}
+
+// Errors introduced during PCR:
+func (f Frag) GetPcrErrors() []SeqEdit {
+	if f.variant == nil {
+		return nil
+	}
+	return f.variant.Errors
+}
+
+// UMI of the source pre-PCR molecule, nil if not attached:
+func (f Frag) GetUmi() *UmiTag {
+	if f.variant == nil {
+		return nil
+	}
+	return f.variant.Umi
+}
+
+// Origin of the source molecule:
+func (f Frag) GetOrigin() string {
+	if f.tr == nil {
+		return OriginMRNA
+	}
+	return f.tr.GetOrigin()
+}
+
 func (f Frag) GetName() string {
 	if f.tr == nil {
 		return "<nil>"
@@ -121,6 +194,38 @@ func (f Frag) GetName() string {
 }
 
 func (f Frag) String() string {
-	s := fmt.Sprintf(">Fg_%d_%s (Strand %s Offset %d -- %d)\n%s", f.GetId(), f.GetName(), f.GetStrand(), f.GetStart(), f.GetEnd(), f.GetSeq())
+	s := fmt.Sprintf(">Fg_%d_%s (Strand %s Offset %d -- %d)", f.GetId(), f.GetName(), f.GetStrand(), f.GetStart(), f.GetEnd())
+	s += f.GetTags()
+	s += "\n" + f.GetSeq()
+	return s
+}
+
+func (f Frag) IsChimera() bool {
+	return false
+}
+
+// Additional information recorded in the header:
+func (f Frag) GetTags() string {
+	var s string
+	// Record the strand of the originating molecule:
+	if f.rnaStrand != "" {
+		s += fmt.Sprintf(" RNAStrand=%s", f.rnaStrand)
+	}
+	// Tag contaminating fragments by origin:
+	if origin := f.GetOrigin(); origin != OriginMRNA {
+		s += fmt.Sprintf(" Origin=%s", origin)
+	}
+	// Record the source molecule and the pre-PCR fragment:
+	if lin := f.GetLineage(); lin != nil {
+		s += fmt.Sprintf(" MolId=%d FragId=%d", lin.MolId, lin.FragId)
+	}
+	// Record the errors introduced during PCR in transcript coordinates:
+	if errs := f.GetPcrErrors(); len(errs) > 0 {
+		s += " PcrErrors=" + FormatEdits(f.variant, f.start)
+	}
+	// Record the breakpoint of PCR chimeras:
+	if f.variant != nil && f.variant.Junction != nil {
+		s += " PcrChimera=" + f.variant.Junction.String()
+	}
 	return s
 }
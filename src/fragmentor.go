@@ -36,29 +36,43 @@ type Fragmentor interface {
 	JettisonPrimerCache()
 }
 
-func NewFragmentor(method *FragMethod, primingTemp float64, kmerLength uint32, tg Targeter, fragLossProb float64) Fragmentor {
+func NewFragmentor(method *FragMethod, primingParam *PrimingParam, tg Targeter, fragLossProb float64) Fragmentor {
 	var fg Fragmentor
 	fragFilter := NewFragFilter(fragLossProb)
 	L.PrintfV("Fragmentation method: \"%s\" with parameter %d.", method.Name, method.Param)
 	switch method.Name {
 	case "after_prim":
-		fg = NewFragAfterPrim(uint32(method.Param), primingTemp, kmerLength, tg, fragFilter, true, false)
+		fg = NewFragAfterPrim(uint32(method.Param), primingParam, tg, fragFilter, true, false)
 	case "after_prim_double":
-		fg = NewFragAfterPrim(uint32(method.Param), primingTemp, kmerLength, tg, fragFilter, true, true)
+		fg = NewFragAfterPrim(uint32(method.Param), primingParam, tg, fragFilter, true, true)
 	case "after_noprim":
-		fg = NewFragAfterPrim(uint32(method.Param), primingTemp, kmerLength, tg, fragFilter, false, false)
+		fg = NewFragAfterPrim(uint32(method.Param), primingParam, tg, fragFilter, false, false)
 	case "after_noprim_double":
-		fg = NewFragAfterPrim(uint32(method.Param), primingTemp, kmerLength, tg, fragFilter, false, true)
+		fg = NewFragAfterPrim(uint32(method.Param), primingParam, tg, fragFilter, false, true)
 	case "pre_prim":
-		fg = NewFragPrePrim(uint32(method.Param), primingTemp, kmerLength, tg, fragFilter)
+		fg = NewFragPrePrim(uint32(method.Param), primingParam, tg, fragFilter)
 	case "prim_jump":
-		fg = NewFragPrimJump(uint32(method.Param), primingTemp, kmerLength, tg, fragFilter)
+		fg = NewFragPrimJump(uint32(method.Param), primingParam, tg, fragFilter)
 	default:
 		L.Fatal("Invalid fragmentation method.")
 	}
 	return fg
 }
 
+// Sample the primer imprinted bases at the start (and optionally at the end) of a fragment.
+// The position of the reverse priming event is given in reverse strand coordinates.
+func SampleFragVariant(primer Primer, bindProfs *BindingProfiles, start uint32, revStart uint32, double bool, rand Rander) *FragVariant {
+	startSite := primer.SampleBindingSite(bindProfs.ForwardSeq, start, rand)
+	var endSite string
+	if double {
+		endSite = RevCompDNA(primer.SampleBindingSite(bindProfs.ReverseSeq, revStart, rand))
+	}
+	if startSite == "" && endSite == "" {
+		return nil
+	}
+	return &FragVariant{StartSite: startSite, EndSite: endSite}
+}
+
 // Fragmentation method: after_prim
 type FragAfterPrim struct {
 	primingTemp float64
@@ -70,13 +84,13 @@ type FragAfterPrim struct {
 	fragFilter  FragFilter
 }
 
-func NewFragAfterPrim(fragParam uint32, pbias float64, kmerLength uint32, tg Targeter, fragFilter FragFilter, simPriming bool, doublePrime bool) *FragAfterPrim {
+func NewFragAfterPrim(fragParam uint32, primingParam *PrimingParam, tg Targeter, fragFilter FragFilter, simPriming bool, doublePrime bool) *FragAfterPrim {
 	fr := new(FragAfterPrim)
 	fr.simPriming = simPriming
 	fr.doublePrime = doublePrime
-	fr.primingTemp = pbias
+	fr.primingTemp = primingParam.Temp
 	fr.target = tg
-	fr.primer = NewNNthermo(pbias, kmerLength)
+	fr.primer = NewNNthermo(primingParam)
 	fr.fragParam = uint32(fragParam)
 	fr.fragFilter = fragFilter
 	return fr
@@ -138,15 +152,23 @@ FRAG:
 		}
 
 		// Simulate priming:
-		var new_start uint32
+		var new_start, ns uint32
 		if fr.simPriming {
 			// Use binding energies to select fragment start:
-			new_start = fr.primer.SimulatePriming(bindProfs.Forward, start, end, rand)
+			var ok bool
+			new_start, ok = fr.primer.SimulatePriming(bindProfs.Forward, start, end, rand)
+			if !ok {
+				// No primer binds to the fragment:
+				continue FRAG
+			}
 			// Select end by priming simulation as well:
 			if fr.doublePrime {
 				final := uint32(tr.GetLen() - 1)                   // needed for coordinate transformation.
 				s, e := (final - end + 1), (final - new_start + 1) // "reverse complement" coordinates.
-				ns := fr.primer.SimulatePriming(bindProfs.Reverse, s, e, rand)
+				ns, ok = fr.primer.SimulatePriming(bindProfs.Reverse, s, e, rand)
+				if !ok {
+					continue FRAG
+				}
 				end = final - ns + 1 // "reverse complement" coordinates.
 			}
 		} else {
@@ -168,8 +190,16 @@ FRAG:
 			continue FRAG
 		}
 
+		// Sample the sites of the primers, which might bind with mismatches:
+		var v *FragVariant
+		if fr.simPriming {
+			v = SampleFragVariant(fr.primer, bindProfs, new_start, ns, fr.doublePrime, rand)
+		}
+
 		// Update transcript tables:
-		tr.RegisterFragment(size, new_start, end)
+		if !tr.RegisterFragment(size, new_start, end, v) {
+			continue FRAG
+		}
 		// Update fragment statistics:
 		st.UpdateAfterFrag(size)
 	}
@@ -188,11 +218,11 @@ type FragPrePrim struct {
 	fragFilter  FragFilter
 }
 
-func NewFragPrePrim(fragParam uint32, pbias float64, kmerLength uint32, tg Targeter, fragFilter FragFilter) *FragPrePrim {
+func NewFragPrePrim(fragParam uint32, primingParam *PrimingParam, tg Targeter, fragFilter FragFilter) *FragPrePrim {
 	fr := new(FragPrePrim)
-	fr.primingTemp = pbias
+	fr.primingTemp = primingParam.Temp
 	fr.target = tg
-	fr.primer = NewNNthermo(pbias, kmerLength)
+	fr.primer = NewNNthermo(primingParam)
 	fr.fragParam = (1.0 / float64(fragParam))
 	fr.fragFilter = fragFilter
 	return fr
@@ -263,7 +293,9 @@ FRAG:
 		}
 
 		// Update transcript tables:
-		tr.RegisterFragment(size, start, end)
+		if !tr.RegisterFragment(size, start, end, nil) {
+			continue FRAG
+		}
 		// Update fragment statistics:
 		st.UpdateAfterFrag(size)
 	}
@@ -283,15 +315,15 @@ type FragPrimJump struct {
 	fragFilter  FragFilter
 }
 
-func NewFragPrimJump(fragParam uint32, pbias float64, kmerLength uint32, tg Targeter, fragFilter FragFilter) *FragPrimJump {
+func NewFragPrimJump(fragParam uint32, primingParam *PrimingParam, tg Targeter, fragFilter FragFilter) *FragPrimJump {
 	fr := new(FragPrimJump)
-	fr.primingTemp = pbias
+	fr.primingTemp = primingParam.Temp
 	fr.target = tg
-	fr.primer = NewNNthermo(pbias, kmerLength)
+	fr.primer = NewNNthermo(primingParam)
 	if fragParam != 0 {
 		fr.fragParam = (1.0 / float64(fragParam))
 	}
-	fr.kmerLength = kmerLength
+	fr.kmerLength = primingParam.KmerLength
 	fr.fragFilter = fragFilter
 	return fr
 }
@@ -314,7 +346,12 @@ func (fr FragPrimJump) Fragment(tr Transcripter, bindProfs *BindingProfiles, pol
 FRAG:
 	for end < final {
 		// Simulate priming:
-		start = fr.primer.SimulatePriming(bindProfs.Forward, end, final, rand)
+		var ok bool
+		start, ok = fr.primer.SimulatePriming(bindProfs.Forward, end, final, rand)
+		if !ok {
+			// No primer binds downstream:
+			break FRAG
+		}
 
 		// Sample fragment length:
 		if fr.fragParam != 0.0 {
@@ -341,8 +378,13 @@ FRAG:
 			continue FRAG
 		}
 
+		// Sample the site of the primer, which might bind with mismatches:
+		v := SampleFragVariant(fr.primer, bindProfs, start, 0, false, rand)
+
 		// Update transcript tables:
-		tr.RegisterFragment(size, start, end)
+		if !tr.RegisterFragment(size, start, end, v) {
+			continue FRAG
+		}
 		// Update fragment statistics:
 		st.UpdateAfterFrag(size)
 
@@ -28,6 +28,11 @@
 
 package main
 
+import (
+	"sort"
+	"sync"
+)
+
 type FragStater interface {
 	UpdateTrLengths(length uint32, count uint64)
 	UpdateExprLevels(level uint32)
@@ -38,6 +43,18 @@ type FragStater interface {
 	UpdateNrSampled(count uint64)
 	UpdateMissing(length uint32, count uint64)
 	UpdatePolyALen(length uint32)
+	UpdateReadStartMismatches(mm []int)
+	UpdateLineage(tr Transcripter, lin *Lineage)
+	UpdateCapture(tailLen uint32, captured bool)
+	UpdateInternalPriming(truncated uint32)
+	UpdateDepletion(origin string, removed bool)
+	UpdateSampledOrigin(origin string)
+	UpdateChimera(microhomology uint32)
+	UpdateShortInsert(length uint32)
+	UpdatePcrErrors(nr uint32)
+	UpdatePcrChimera(j *PcrJunction)
+	UpdateSeqFeatures(factor float64, count uint64)
+	UpdatePcrTrajectory(t *PcrTrajectory)
 	ReportFragStats(rep Reporter)
 	LogSamplingRatio(sampled uint64)
 }
@@ -51,8 +68,26 @@ type FragStats struct {
 	Sampled       LenCountMap
 	Missing       LenCountMap
 	PolyALen      LenCountMap
+	StartMism     LenCountMap
 	TotalFrags    *uint64
 	NrSampled     *uint64
+	NrReadStarts  *uint64
+	CaptureTried  LenCountMap
+	Captured      LenCountMap
+	InternalPrim  LenCountMap
+	Depleted      map[string]uint64
+	NotDepleted   map[string]uint64
+	OriginCounts  map[string]uint64
+	Chimeras      LenCountMap
+	ShortInserts  LenCountMap
+	PcrErrors     LenCountMap
+	PcrChimeras   LenCountMap
+	PcrInterChims *uint64
+	SeqFeatures   LenCountMap
+	PcrCycles     *PcrTrajectory
+	SampledFrags  map[string]uint64
+	DistinctFrags map[string]map[uint64]bool
+	lock          *sync.Mutex
 }
 
 func NewFragStats() (st *FragStats) {
@@ -65,23 +100,49 @@ func NewFragStats() (st *FragStats) {
 	st.Sampled = make(LenCountMap)
 	st.Missing = make(LenCountMap)
 	st.PolyALen = make(LenCountMap)
+	st.StartMism = make(LenCountMap)
 	st.TotalFrags = new(uint64)
 	st.NrSampled = new(uint64)
+	st.NrReadStarts = new(uint64)
+	st.CaptureTried = make(LenCountMap)
+	st.Captured = make(LenCountMap)
+	st.InternalPrim = make(LenCountMap)
+	st.Depleted = make(map[string]uint64)
+	st.NotDepleted = make(map[string]uint64)
+	st.OriginCounts = make(map[string]uint64)
+	st.Chimeras = make(LenCountMap)
+	st.ShortInserts = make(LenCountMap)
+	st.PcrErrors = make(LenCountMap)
+	st.PcrChimeras = make(LenCountMap)
+	st.PcrInterChims = new(uint64)
+	st.SeqFeatures = make(LenCountMap)
+	st.PcrCycles = NewPcrTrajectory()
+	st.SampledFrags = make(map[string]uint64)
+	st.DistinctFrags = make(map[string]map[uint64]bool)
+	st.lock = new(sync.Mutex)
 	return
 }
 
 func (st FragStats) UpdateTrLengths(length uint32, count uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	st.TrLengths[length] += count
 }
 func (st FragStats) UpdateExprLevels(level uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	st.ExprLevels[level]++
 }
 
 func (st FragStats) UpdateAfterFrag(length uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	st.AfterFrag[length]++
 }
 
 func (st FragStats) UpdateAfterPcr(length uint32, count uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	st.AfterPcr[length] += count
 	st.AfterSampling[length] += count
 
@@ -95,6 +156,8 @@ func (st FragStats) UpdateAfterPcr(length uint32, count uint64) {
 }
 
 func (st FragStats) UpdateAfterSampling(length uint32, count uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	if count > st.AfterSampling[length] {
 		L.Panic("BIG trouble", count, st.AfterSampling[length])
 	}
@@ -102,21 +165,281 @@ func (st FragStats) UpdateAfterSampling(length uint32, count uint64) {
 }
 
 func (st FragStats) UpdateSampled(length uint32, count uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	st.Sampled[length] += count
 }
 
 func (st FragStats) UpdateNrSampled(count uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	*st.NrSampled = count
 }
 
 func (st FragStats) UpdateMissing(length uint32, count uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	st.Missing[length] += count
 }
 
 func (st FragStats) UpdatePolyALen(length uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	st.PolyALen[length]++
 }
 
+func (st FragStats) UpdateReadStartMismatches(mm []int) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	*st.NrReadStarts++
+	for _, pos := range mm {
+		st.StartMism[uint32(pos)]++
+	}
+}
+
+func (st FragStats) UpdateCapture(tailLen uint32, captured bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.CaptureTried[tailLen]++
+	if captured {
+		st.Captured[tailLen]++
+	}
+}
+
+// Record the number of bases lost by internal priming:
+func (st FragStats) UpdateInternalPriming(truncated uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.InternalPrim[truncated]++
+}
+
+// Report poly(A) capture efficiency and internal priming:
+func (st FragStats) ReportCapture(r Reporter) {
+	var tried, captured, internal uint64
+	if len(st.CaptureTried) > 0 {
+		lengths := make([]int, 0, len(st.CaptureTried))
+		for l, count := range st.CaptureTried {
+			lengths = append(lengths, int(l))
+			tried += count
+			captured += st.Captured[l]
+		}
+		sort.Ints(lengths)
+		x, y := make([]uint32, len(lengths)), make([]float64, len(lengths))
+		for i, l := range lengths {
+			x[i] = uint32(l)
+			y[i] = float64(st.Captured[x[i]]) / float64(st.CaptureTried[x[i]])
+		}
+		r.ReportSliceInt32f64(x, y, "Poly(A) length", "Capture rate", "Poly(A) capture rate", "bar")
+	}
+	if len(st.InternalPrim) > 0 {
+		for _, count := range st.InternalPrim {
+			internal += count
+		}
+		r.ReportMapInt32t64(st.InternalPrim, "Truncated bases", "Count", "Internal priming truncation", "bar")
+	}
+	if tried+internal > 0 {
+		L.PrintfV("Captured molecules: %d out of %d (internally primed: %d)\n", captured+internal, tried+internal, internal)
+	}
+}
+
+// Record the fate of a contaminating molecule during depletion:
+func (st FragStats) UpdateDepletion(origin string, removed bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if removed {
+		st.Depleted[origin]++
+	} else {
+		st.NotDepleted[origin]++
+	}
+}
+
+// Record the origin of a sampled fragment:
+func (st FragStats) UpdateSampledOrigin(origin string) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.OriginCounts[origin]++
+}
+
+// Report the fraction of sampled fragments by origin:
+func (st FragStats) ReportOrigins(r Reporter) {
+	for origin, _ := range st.Depleted {
+		if _, ok := st.NotDepleted[origin]; !ok {
+			st.NotDepleted[origin] = 0
+		}
+	}
+	for origin, nd := range st.NotDepleted {
+		d := st.Depleted[origin]
+		L.PrintfV("Molecules removed by %s depletion: %d out of %d\n", origin, d, d+nd)
+	}
+	if len(st.OriginCounts) < 2 {
+		return
+	}
+	var total uint64
+	for _, count := range st.OriginCounts {
+		total += count
+	}
+	fractions := make(map[string]float64, len(st.OriginCounts))
+	for origin, count := range st.OriginCounts {
+		fractions[origin] = float64(count) / float64(total)
+		L.PrintfV("Fraction of %s fragments: %g\n", origin, fractions[origin])
+	}
+	r.ReportMapStringf64(fractions, "Origin", "Fraction", "Sampled fragments by origin", "table")
+}
+
+// Record a chimeric fragment by the length of microhomology at the junction:
+func (st FragStats) UpdateChimera(microhomology uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.Chimeras[microhomology]++
+}
+
+// Report chimeric fragments:
+func (st FragStats) ReportChimeras(r Reporter) {
+	if len(st.Chimeras) == 0 {
+		return
+	}
+	var total uint64
+	for _, count := range st.Chimeras {
+		total += count
+	}
+	if *st.NrSampled > 0 {
+		L.PrintfV("Chimeric fragments: %d (rate: %g)\n", total, float64(total)/float64(*st.NrSampled))
+	}
+	r.ReportMapInt32t64(st.Chimeras, "Microhomology length", "Count", "Chimeric junctions", "bar")
+}
+
+// Record a short insert, adapter dimers have zero length:
+func (st FragStats) UpdateShortInsert(length uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.ShortInserts[length]++
+}
+
+// Report adapter dimers and short inserts:
+func (st FragStats) ReportShortInserts(r Reporter) {
+	if len(st.ShortInserts) == 0 {
+		return
+	}
+	var total uint64
+	for _, count := range st.ShortInserts {
+		total += count
+	}
+	L.PrintfV("Adapter dimers: %d, short inserts: %d\n", st.ShortInserts[0], total-st.ShortInserts[0])
+	r.ReportMapInt32t64(st.ShortInserts, "Insert length", "Count", "Adapter dimers and short inserts", "bar")
+}
+
+// Record the number of PCR errors carried by a sampled fragment:
+func (st FragStats) UpdatePcrErrors(nr uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.PcrErrors[nr]++
+}
+
+// Report the distribution of PCR errors in sampled fragments:
+func (st FragStats) ReportPcrErrors(r Reporter) {
+	var faulty uint64
+	for nr, count := range st.PcrErrors {
+		if nr > 0 {
+			faulty += count
+		}
+	}
+	if faulty == 0 {
+		return
+	}
+	L.PrintfV("Sampled fragments carrying PCR errors: %d\n", faulty)
+	r.ReportMapInt32t64(st.PcrErrors, "PCR errors", "Count", "PCR errors per sampled fragment", "bar")
+}
+
+// Record a PCR chimera, chimeras within a transcript by the distance between the
+// breakpoint positions:
+func (st FragStats) UpdatePcrChimera(j *PcrJunction) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if j.Partner != "" {
+		*st.PcrInterChims++
+		return
+	}
+	st.PcrChimeras[j.Shift()]++
+}
+
+// Report the PCR chimeras formed during amplification:
+func (st FragStats) ReportPcrChimeras(r Reporter) {
+	var within uint64
+	for _, count := range st.PcrChimeras {
+		within += count
+	}
+	if within+*st.PcrInterChims == 0 {
+		return
+	}
+	L.PrintfV("PCR chimeras formed: %d (between transcripts: %d)\n", within+*st.PcrInterChims, *st.PcrInterChims)
+	if within == 0 {
+		return
+	}
+	r.ReportMapInt32t64(st.PcrChimeras, "Breakpoint shift", "Count", "PCR chimera breakpoint shifts", "bar")
+}
+
+// Record the pre-PCR fragment of a sampled fragment:
+func (st FragStats) UpdateLineage(tr Transcripter, lin *Lineage) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if lin == nil {
+		return
+	}
+	name := tr.GetName()
+	st.SampledFrags[name]++
+	d, ok := st.DistinctFrags[name]
+	if !ok {
+		d = make(map[uint64]bool)
+		st.DistinctFrags[name] = d
+	}
+	d[lin.FragId] = true
+}
+
+// Report the fraction of sampled fragments which are PCR duplicates:
+func (st FragStats) ReportDuplicateRates(r Reporter) {
+	if len(st.SampledFrags) == 0 {
+		return
+	}
+	rates := make(map[string]float64, len(st.SampledFrags))
+	var sampled, distinct uint64
+	for name, count := range st.SampledFrags {
+		nd := uint64(len(st.DistinctFrags[name]))
+		rates[name] = 1.0 - float64(nd)/float64(count)
+		sampled += count
+		distinct += nd
+	}
+	L.PrintfV("Duplicate rate: %g\n", 1.0-float64(distinct)/float64(sampled))
+	r.ReportMapStringf64(rates, "Transcript", "Duplicate rate", "Duplicate rate per transcript", "table")
+}
+
+// Record the sequence feature efficiency factor of pre-PCR fragments in percents:
+func (st FragStats) UpdateSeqFeatures(factor float64, count uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.SeqFeatures[uint32(factor*100.0+0.5)] += count
+}
+
+// Report the distribution of the sequence feature efficiency factors:
+func (st FragStats) ReportSeqFeatures(r Reporter) {
+	if len(st.SeqFeatures) == 0 {
+		return
+	}
+	var total, sum float64
+	for pc, count := range st.SeqFeatures {
+		total += float64(count)
+		sum += float64(pc) * float64(count)
+	}
+	L.PrintfV("Mean sequence feature efficiency factor: %.2f\n", sum/total/100.0)
+	r.ReportMapInt32t64(st.SeqFeatures, "Efficiency factor (%)", "Count", "Sequence feature efficiency factors", "bar")
+}
+
+// Add the molecule counts per cycle of a transcript:
+func (st FragStats) UpdatePcrTrajectory(t *PcrTrajectory) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.PcrCycles.Merge(t)
+}
+
 func (st FragStats) ReportFragStats(r Reporter) {
 	r.ReportMapInt32t64(st.AfterFrag, "Length", "Count", "Fragdist after fragmentation", "bar")
 	r.ReportMapInt32t64(st.AfterPcr, "Length", "Count", "Fragdist after PCR", "bar")
@@ -127,6 +450,16 @@ func (st FragStats) ReportFragStats(r Reporter) {
 	r.ReportMapInt32t64(st.TrLengths, "Length", "Count", "Transcript lengths", "hist")
 	r.ReportMapInt32t64(st.ExprLevels, "Expression level", "Count", "Expression levels", "hist")
 	st.ReportSamplingRatio(r)
+	st.ReportStartMismatchRate(r)
+	st.ReportDuplicateRates(r)
+	st.ReportCapture(r)
+	st.ReportOrigins(r)
+	st.ReportChimeras(r)
+	st.ReportShortInserts(r)
+	st.ReportPcrErrors(r)
+	st.ReportPcrChimeras(r)
+	st.ReportSeqFeatures(r)
+	st.PcrCycles.Report(r)
 }
 
 func (st FragStats) LogSamplingRatio(sampled uint64) {
@@ -139,3 +472,22 @@ func (st FragStats) ReportSamplingRatio(r Reporter) {
 	y := [...]float64{float64(*st.NrSampled) / float64(*st.TotalFrags)}
 	r.ReportSliceFloat64f64(x[:], y[:], "", "Sampling ratio", "Sampling ratio", "bar")
 }
+
+func (st FragStats) ReportStartMismatchRate(r Reporter) {
+	if len(st.StartMism) == 0 || *st.NrReadStarts == 0 {
+		return
+	}
+	var max uint32
+	for pos, _ := range st.StartMism {
+		if pos > max {
+			max = pos
+		}
+	}
+	x := make([]uint32, max+1)
+	y := make([]float64, max+1)
+	for i := uint32(0); i <= max; i++ {
+		x[i] = i + 1
+		y[i] = float64(st.StartMism[i]) / float64(*st.NrReadStarts)
+	}
+	r.ReportSliceInt32f64(x, y, "Position", "Mismatch rate", "Read start mismatch rate", "bar")
+}
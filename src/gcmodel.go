@@ -0,0 +1,281 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Mapping from GC content to amplification efficiency:
+type GcModel interface {
+	Eff(gc float64) float64
+	String() string
+}
+
+// The original parametric model: min + (max-min)*(1-gc^shape)^shape
+type ShapeGcModel struct {
+	Param *EffParam
+}
+
+func (m ShapeGcModel) Eff(gc float64) float64 {
+	p := m.Param
+	return p.Min + (p.Max-p.Min)*math.Pow((1-math.Pow(gc, p.Shape)), p.Shape)
+}
+
+func (m ShapeGcModel) String() string {
+	return "shape:" + m.Param.String()
+}
+
+// Raw efficiencies in 1% GC bins:
+type RawGcModel struct {
+	Effs []float64
+}
+
+func (m RawGcModel) Eff(gc float64) float64 {
+	return m.Effs[int(gc*100)]
+}
+
+func (m RawGcModel) String() string {
+	return "raw"
+}
+
+// Logistic decline around the midpoint: min + (max-min)/(1+exp(slope*(gc-mid)))
+type LogisticGcModel struct {
+	Mid   float64
+	Slope float64
+	Min   float64
+	Max   float64
+}
+
+func (m LogisticGcModel) Eff(gc float64) float64 {
+	return m.Min + (m.Max-m.Min)/(1.0+math.Exp(m.Slope*(gc-m.Mid)))
+}
+
+func (m LogisticGcModel) String() string {
+	return fmt.Sprintf("logistic:(%g, %g, %g, %g)", m.Mid, m.Slope, m.Min, m.Max)
+}
+
+// Control points sorted by GC content:
+type ControlPoints struct {
+	X []float64
+	Y []float64
+}
+
+func (c ControlPoints) String() string {
+	s := make([]string, len(c.X))
+	for i := range c.X {
+		s[i] = fmt.Sprintf("%g:%g", c.X[i], c.Y[i])
+	}
+	return "(" + strings.Join(s, ", ") + ")"
+}
+
+// Index of the interval containing x, the model is constant outside the control points:
+func (c ControlPoints) interval(x float64) (int, bool) {
+	n := len(c.X)
+	if x <= c.X[0] || x >= c.X[n-1] {
+		return 0, false
+	}
+	return sort.SearchFloat64s(c.X, x) - 1, true
+}
+
+func (c ControlPoints) outside(x float64) float64 {
+	if x <= c.X[0] {
+		return c.Y[0]
+	}
+	return c.Y[len(c.Y)-1]
+}
+
+// Linear interpolation between control points:
+type LinearGcModel struct {
+	ControlPoints
+}
+
+func (m LinearGcModel) Eff(gc float64) float64 {
+	i, ok := m.interval(gc)
+	if !ok {
+		return m.outside(gc)
+	}
+	t := (gc - m.X[i]) / (m.X[i+1] - m.X[i])
+	return m.Y[i] + t*(m.Y[i+1]-m.Y[i])
+}
+
+func (m LinearGcModel) String() string {
+	return "linear:" + m.ControlPoints.String()
+}
+
+// Natural cubic spline through the control points, clamped to [0, 1]:
+type SplineGcModel struct {
+	ControlPoints
+	M []float64 // Second derivatives at the control points.
+}
+
+func NewSplineGcModel(c ControlPoints) *SplineGcModel {
+	n := len(c.X)
+	m := make([]float64, n)
+	// Solve the tridiagonal system for the inner second derivatives:
+	if n > 2 {
+		diag := make([]float64, n)
+		rhs := make([]float64, n)
+		for i := 1; i < n-1; i++ {
+			h0, h1 := c.X[i]-c.X[i-1], c.X[i+1]-c.X[i]
+			diag[i] = 2.0 * (h0 + h1)
+			rhs[i] = 6.0 * ((c.Y[i+1]-c.Y[i])/h1 - (c.Y[i]-c.Y[i-1])/h0)
+			if i > 1 {
+				w := h0 / diag[i-1]
+				diag[i] -= w * h0
+				rhs[i] -= w * rhs[i-1]
+			}
+		}
+		for i := n - 2; i > 0; i-- {
+			m[i] = rhs[i]
+			if i < n-2 {
+				m[i] -= (c.X[i+1] - c.X[i]) * m[i+1]
+			}
+			m[i] /= diag[i]
+		}
+	}
+	return &SplineGcModel{c, m}
+}
+
+func (m SplineGcModel) Eff(gc float64) float64 {
+	i, ok := m.interval(gc)
+	if !ok {
+		return m.outside(gc)
+	}
+	h := m.X[i+1] - m.X[i]
+	a := (m.X[i+1] - gc) / h
+	b := (gc - m.X[i]) / h
+	y := a*m.Y[i] + b*m.Y[i+1] + ((a*a*a-a)*m.M[i]+(b*b*b-b)*m.M[i+1])*h*h/6.0
+	return math.Min(math.Max(y, 0.0), 1.0)
+}
+
+func (m SplineGcModel) String() string {
+	return "spline:" + m.ControlPoints.String()
+}
+
+// Parse a GC model string such as "logistic:(0.6,20,0.1,0.95)" or "spline:(0.2:0.5,0.5:0.9,0.8:0.3)":
+func ParseGcModelString(s string) GcModel {
+	s = strings.TrimSpace(s)
+	spl := strings.SplitN(s, ":", 2)
+	if len(spl) != 2 {
+		L.Fatalf("Invalid GC model string: %s", s)
+	}
+	name, param := strings.ToLower(strings.TrimSpace(spl[0])), strings.TrimSpace(spl[1])
+	if len(param) < 2 || param[0] != '(' || param[len(param)-1] != ')' {
+		L.Fatalf("Missing paranthesis in GC model string: %s", s)
+	}
+	switch name {
+	case "shape":
+		return ShapeGcModel{ParseEffParamString(param)}
+	case "logistic":
+		m := LogisticGcModel{}
+		n, e := fmt.Sscanf(param[1:len(param)-1], "%f,%f,%f,%f", &m.Mid, &m.Slope, &m.Min, &m.Max)
+		if n != 4 || e != nil {
+			L.Fatalf("Failed to parse logistic GC model parameters: %s", param)
+		}
+		checkEffRange(m.Min)
+		checkEffRange(m.Max)
+		return m
+	case "linear":
+		return LinearGcModel{parseControlPoints(param[1 : len(param)-1])}
+	case "spline":
+		return NewSplineGcModel(parseControlPoints(param[1 : len(param)-1]))
+	}
+	L.Fatalf("Unknown GC model: %s", name)
+	return nil
+}
+
+func parseControlPoints(s string) ControlPoints {
+	c := ControlPoints{}
+	for _, tok := range strings.Split(s, ",") {
+		var x, y float64
+		n, e := fmt.Sscanf(strings.TrimSpace(tok), "%f:%f", &x, &y)
+		if n != 2 || e != nil {
+			L.Fatalf("Failed to parse control point: %s", tok)
+		}
+		if x < 0.0 || x > 1.0 {
+			L.Fatalf("The GC content %g of a control point is outside the range [0, 1]!", x)
+		}
+		checkEffRange(y)
+		if len(c.X) > 0 && x <= c.X[len(c.X)-1] {
+			L.Fatalf("The control points must be sorted by GC content!")
+		}
+		c.X = append(c.X, x)
+		c.Y = append(c.Y, y)
+	}
+	if len(c.X) < 2 {
+		L.Fatalf("At least two control points are required!")
+	}
+	return c
+}
+
+func checkEffRange(e float64) {
+	if e < 0.0 || e > 1.0 {
+		L.Fatalf("The efficiency %g is outside the range [0, 1]!", e)
+	}
+}
+
+// GC content of a sequence:
+func SeqGcContent(seq string) float64 {
+	gc, _ := SeqGcRange(seq, len(seq))
+	return gc
+}
+
+// Minimum and maximum GC content over the sliding windows of a sequence:
+func SeqGcRange(seq string, w int) (lo float64, hi float64) {
+	prefix := make([]uint32, len(seq)+1)
+	for i := 0; i < len(seq); i++ {
+		prefix[i+1] = prefix[i]
+		if seq[i] == 'G' || seq[i] == 'C' {
+			prefix[i+1]++
+		}
+	}
+	return gcWindowRange(prefix, 0, uint32(len(seq)), uint32(w))
+}
+
+func gcWindowRange(prefix []uint32, start uint32, end uint32, w uint32) (lo float64, hi float64) {
+	if end-start <= w {
+		gc := float64(prefix[end]-prefix[start]) / float64(end-start)
+		return gc, gc
+	}
+	min, max := w+1, uint32(0)
+	for i := start; i+w <= end; i++ {
+		c := prefix[i+w] - prefix[i]
+		if c < min {
+			min = c
+		}
+		if c > max {
+			max = c
+		}
+	}
+	return float64(min) / float64(w), float64(max) / float64(w)
+}
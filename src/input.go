@@ -38,13 +38,15 @@ import (
 
 type Inputer interface {
 	NextSeq() *Seq
-	GetTranscriptChan(tmpDir string, polyAmax int, st FragStater, exprMul float64) (c chan *Transcript)
+	GetTranscriptChan(store *FragStore, polyAmax int, st FragStater, exprMul float64) (c chan *Transcript)
+	AddContamSource(cs *ContamSource)
 }
 
 type Input struct {
 	InputFiles []string
 	Funnel     io.Reader
 	SeqReader  SeqReader
+	Contams    *[]*ContamSource
 }
 
 func NewInput(InputFiles []string) Input {
@@ -70,10 +72,17 @@ func NewInput(InputFiles []string) Input {
 	fr := NewFastaReader(buffReader)
 	sr := NewFastaToSeq(fr)
 	res.SeqReader = sr
+	contams := make([]*ContamSource, 0)
+	res.Contams = &contams
 
 	return res
 }
 
+// Add a source of contaminating molecules:
+func (input Input) AddContamSource(cs *ContamSource) {
+	*input.Contams = append(*input.Contams, cs)
+}
+
 func (input Input) NextSeq() *Seq {
 	sr := input.SeqReader
 	return sr.NextSeq()
@@ -100,10 +109,11 @@ func (input Input) ParseSeqName(s string) (name string, level uint64, ok bool) {
 	return
 }
 
-func (input Input) GetTranscriptChan(tmpDir string, polyAmax int, st FragStater, exprMul float64) (c chan *Transcript) {
+func (input Input) GetTranscriptChan(store *FragStore, polyAmax int, st FragStater, exprMul float64) (c chan *Transcript) {
 	c = make(chan *Transcript, 1000)
 
 	go func() {
+		var total uint64
 		for seq := input.NextSeq(); seq != nil; seq = input.NextSeq() {
 			name, level, ok := input.ParseSeqName(seq.Name)
 			if !ok {
@@ -115,9 +125,14 @@ func (input Input) GetTranscriptChan(tmpDir string, polyAmax int, st FragStater,
 			st.UpdateTrLengths(uint32(len(seq.Seq)), level)
 			// Update expression level distribution:
 			st.UpdateExprLevels(uint32(level))
-			tr := NewTranscript(name, seq.Seq, level, polyAmax, tmpDir)
+			tr := NewTranscript(name, seq.Seq, level, polyAmax, store)
+			total += level
 			c <- tr
 		}
+		// Append contaminating molecules:
+		for _, cs := range *input.Contams {
+			cs.Emit(total, store, c)
+		}
 		close(c)
 	}()
 	return
@@ -0,0 +1,123 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "fmt"
+
+// Library types describing the relationship between the strand of the
+// originating RNA molecule and the strand of the first read:
+
+type LibType struct {
+	Name       string
+	Sense      bool    // First read is on the strand of the originating RNA.
+	Stranded   bool    // False for unstranded libraries.
+	Leakage    float64 // Antisense leakage rate of stranded protocols.
+	StrandBias float64 // Used only by the legacy "-b" behaviour.
+}
+
+func NewLibType(name string, leakage float64, strandBias float64) *LibType {
+	lt := new(LibType)
+	lt.Name = name
+	lt.StrandBias = strandBias
+	if leakage < 0.0 || leakage > 1.0 {
+		L.Fatalf("The antisense leakage rate must be in the interval [0, 1]!")
+	}
+	lt.Leakage = leakage
+
+	switch name {
+	case "":
+		// Legacy mode: strand sampled by the strand bias parameter.
+	case "unstranded":
+	case "fr-firststrand":
+		// dUTP and similar protocols: the first read is antisense.
+		lt.Stranded = true
+		lt.Sense = false
+	case "fr-secondstrand":
+		// Ligation based protocols: the first read is sense.
+		lt.Stranded = true
+		lt.Sense = true
+	default:
+		L.Fatalf("Invalid library type: %s", name)
+	}
+	if lt.Leakage > 0.0 && !lt.Stranded {
+		L.Fatalf("The antisense leakage rate (-al) requires a stranded library type (-lt)!")
+	}
+
+	if lt.Name != "" {
+		L.PrintfV("Library type: %s", lt.String())
+	}
+	return lt
+}
+
+// Return the opposite strand:
+func FlipStrand(strand string) string {
+	if strand == "+" {
+		return "-"
+	}
+	return "+"
+}
+
+// Sample the strand of the first read given the strand of the originating molecule:
+func (lt LibType) SampleReadStrand(origin string, rand Rander) string {
+	if lt.Name == "" {
+		if rand.Float64() < lt.StrandBias {
+			return "-"
+		}
+		return "+"
+	}
+
+	if !lt.Stranded {
+		if rand.Float64() < 0.5 {
+			return "-"
+		}
+		return "+"
+	}
+
+	strand := origin
+	if !lt.Sense {
+		strand = FlipStrand(origin)
+	}
+	// Antisense leakage (i.e. incomplete digestion of the second strand):
+	if lt.Leakage > 0.0 && rand.Float64() < lt.Leakage {
+		strand = FlipStrand(strand)
+	}
+	return strand
+}
+
+// True if the library type was set explicitly:
+func (lt LibType) IsNamed() bool {
+	return lt.Name != ""
+}
+
+func (lt LibType) String() string {
+	if lt.Name == "" {
+		return fmt.Sprintf("[ strand bias: %g ]", lt.StrandBias)
+	}
+	return fmt.Sprintf("[ name: %s, antisense leakage: %g ]", lt.Name, lt.Leakage)
+}
@@ -92,6 +92,12 @@ func main() {
 	// Initialize input:
 	var input Inputer
 	input = NewInput(args.InputFiles)
+	if args.RRNAFile != "" {
+		input.AddContamSource(NewContamSource(OriginRRNA, args.RRNAFile, args.RRNAFraction, NewDepletion(args.RRNADepletion, args.RRNAProbes)))
+	}
+	if args.GDNAFile != "" {
+		input.AddContamSource(NewGenomicSource(args.GDNAFile, args.GDNAFraction, Rg.Split()))
+	}
 
 	// Initialize target:
 	var target Targeter
@@ -106,7 +112,7 @@ func main() {
 
 	// Initialize fragmentor:
 	var fragmentor Fragmentor
-	fragmentor = NewFragmentor(args.FragMethod, args.PrimingTemp, args.KmerLength, target, args.FragLossProb)
+	fragmentor = NewFragmentor(args.FragMethod, args.PrimingParam, target, args.FragLossProb)
 
 	// Initialize fragment statistics:
 	var stats FragStater
@@ -114,17 +120,30 @@ func main() {
 
 	// Initialize thermocycler:
 	var cycler Thermocycler
-	cycler = NewTechne(args.NrCycles, args.FixedEff, args.GcEffParam, args.RawGcEffs, args.MinRawGcEff, args.LenEffParam, target)
+	features := NewSeqFeatureModel(args.FoldMode, args.FoldWindow, args.FoldScale, args.HomoMin, args.HomoPenalty, args.FeatureFile)
+	cycler = NewTechne(args.NrCycles, args.FixedEff, args.EffSurface, args.GcModel, args.GcWindow, args.GcEffParam, args.RawGcEffs, args.MinRawGcEff, args.LenEffParam, target, NewPcrErrorModel(args.PcrSubRate, args.PcrIndelRate), NewPcrChimeraModel(args.PcrChimRate, args.PcrChimOvl), features, args.PcrCapacity, uint64(args.PcrApprox))
 	// Report efficiency functions:
 	cycler.ReportEffFunctions(target, report)
+	// Compare the approximate and the exact amplification using a separate random stream:
+	if args.PcrApproxCmp {
+		cycler.CompareApprox(report, NewRandGen(StreamSeed(seed, 0)))
+	}
+
+	// Initialize UMIs:
+	umis := NewUmiModel(args.UmiPattern, args.UmiSeqError, args.UmiFile)
 
 	// Initialize sampler
 	var sampler Sampler
-	sampler = NewLenSampler(args.StrandBias)
+	sampler = NewLenSampler(NewLibType(args.LibType, args.AntisenseLeak, args.StrandBias), NewChimerizer(args.ChimeraRate, args.ChimeraMh, args.ReqFrags), NewLibraryBuilder(NewAdapters(args.Adapters), args.DimerRate, args.ShortRate, args.ReadLength, args.FullMolecule), umis)
+
+	// Validate the checkpoint before creating the fragment store:
+	if args.LoadCkpt != "" {
+		CheckCheckpoint(args.LoadCkpt, UpstreamHash(args))
+	}
 
 	//Initialize pool:
 	var pool Pooler
-	pool = NewPool(args.GobDir)
+	pool = NewPool(args.GobDir, args.MmapStore, args.MaxMem, args.Lineage, NewPolyACapture(args.CaptureParam, args.InternalPrim, args.MinARun), umis)
 
 	// Deal with the PCR seed:
 	var pcrRand Rander
@@ -136,8 +155,18 @@ func main() {
 	}
 	// We still need the old global generator wehen simulating fragmentation.
 
-	// Initialize Transcripts
-	pool.InitTranscripts(input, target, fragmentor, cycler, stats, args.GCFreq, args.PolyAParam, args.ExprMul, Rg, pcrRand)
+	if args.LoadCkpt != "" {
+		// Load the amplified pool:
+		stats = pool.LoadCheckpoint(args.LoadCkpt, UpstreamHash(args))
+	} else {
+		// Initialize Transcripts
+		pool.InitTranscripts(input, target, fragmentor, cycler, stats, args.GCFreq, args.PolyAParam, args.ExprMul, int(args.MaxProcs), Rg, pcrRand)
+		features.Close()
+		// Save the amplified pool:
+		if args.SaveCkpt != "" {
+			pool.SaveCheckpoint(args.SaveCkpt, UpstreamHash(args), stats)
+		}
+	}
 
 	// Deal with sampling seed:
 	if args.SamplingSeed != 0 {
@@ -150,6 +179,7 @@ func main() {
 
 	// Sample fragments:
 	sampler.SampleFragments(pool, target, stats, Rg)
+	umis.Close()
 
 	// Report fragment statistics:
 	stats.ReportFragStats(report)
@@ -0,0 +1,188 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"container/list"
+	"runtime"
+	"sync"
+)
+
+// Memory budget of the fragment tables and their variants. Tables of idle transcripts are
+// kept in memory and the least recently used ones are spilled to the store when the budget
+// would be exceeded. The usage is estimated from the sizes of the tables and the number of
+// variants, and the store is accessed without holding the lock:
+type MemBudget struct {
+	Limit    int64
+	used     *int64
+	peak     *int64
+	spills   *uint64
+	sizes    map[uint64]int64         // Accounted size of the tables in memory.
+	idle     *list.List               // Idle transcripts in memory, most recently used first.
+	elems    map[uint64]*list.Element // Positions of the idle transcripts.
+	spilling map[uint64]bool          // Tables being written to the store.
+	lock     *sync.Mutex
+	cond     *sync.Cond // Signals finished spills.
+}
+
+// Table evicted from memory, to be written to the store:
+type spilledTable struct {
+	id    uint64
+	frags map[uint32]StartEndCountStruct
+	vars  []*FragVariant
+	store *FragStore
+}
+
+func NewMemBudget(limit int64) *MemBudget {
+	b := new(MemBudget)
+	b.Limit = limit
+	b.used = new(int64)
+	b.peak = new(int64)
+	b.spills = new(uint64)
+	b.sizes = make(map[uint64]int64)
+	b.idle = list.New()
+	b.elems = make(map[uint64]*list.Element)
+	b.spilling = make(map[uint64]bool)
+	b.lock = new(sync.Mutex)
+	b.cond = sync.NewCond(b.lock)
+	L.PrintfV("Memory budget of the fragment tables: %d bytes", limit)
+	return b
+}
+
+// Approximate memory used by a fragment variant:
+const fragVariantSize = 128
+
+// Approximate memory used by a fragment table and its variants:
+func fragTableSize(m map[uint32]StartEndCountStruct, vars []*FragVariant) int64 {
+	s := fragVariantSize * int64(len(vars))
+	for _, sec := range m {
+		s += 128 + 4*int64(cap(sec.Start)+cap(sec.End)+cap(sec.Var)) + 8*int64(cap(sec.Count))
+	}
+	return s
+}
+
+// Get the fragments of a transcript, loading them from the store if spilled:
+func (b MemBudget) Acquire(tr Transcript) {
+	b.lock.Lock()
+	for b.spilling[tr.id] {
+		b.cond.Wait()
+	}
+	if e, ok := b.elems[tr.id]; ok {
+		b.idle.Remove(e)
+		delete(b.elems, tr.id)
+		b.lock.Unlock()
+		return
+	}
+	b.lock.Unlock()
+	if *tr.FragStructs != nil {
+		L.Fatalf("Ungob tries to replace data for transcript %s", tr.name)
+	}
+	frags, vars := tr.store.Get(tr.id)
+
+	b.lock.Lock()
+	*tr.FragStructs = frags
+	*tr.Variants = vars
+	b.account(tr)
+	victims := b.evict()
+	b.lock.Unlock()
+	b.spill(victims)
+}
+
+// Mark the fragments of a transcript as idle, spilling tables if over budget:
+func (b MemBudget) Release(tr Transcript) {
+	b.lock.Lock()
+	b.account(tr)
+	if _, ok := b.elems[tr.id]; !ok {
+		b.elems[tr.id] = b.idle.PushFront(tr)
+	}
+	victims := b.evict()
+	b.lock.Unlock()
+	b.spill(victims)
+}
+
+// Stop tracking the fragments of a transcript which are discarded:
+func (b MemBudget) Forget(tr Transcript) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.spilling[tr.id] {
+		b.cond.Wait()
+	}
+	if e, ok := b.elems[tr.id]; ok {
+		b.idle.Remove(e)
+		delete(b.elems, tr.id)
+	}
+	*b.used -= b.sizes[tr.id]
+	delete(b.sizes, tr.id)
+}
+
+// Update the accounted size of a table in memory:
+func (b MemBudget) account(tr Transcript) {
+	size := fragTableSize(*tr.FragStructs, *tr.Variants)
+	*b.used += size - b.sizes[tr.id]
+	b.sizes[tr.id] = size
+	if *b.used > *b.peak {
+		*b.peak = *b.used
+	}
+}
+
+// Evict the least recently used idle tables until the usage fits the budget, the
+// evicted tables must be spilled after releasing the lock:
+func (b MemBudget) evict() []spilledTable {
+	var victims []spilledTable
+	for *b.used > b.Limit && b.idle.Len() > 0 {
+		e := b.idle.Back()
+		tr := b.idle.Remove(e).(Transcript)
+		delete(b.elems, tr.id)
+		victims = append(victims, spilledTable{tr.id, *tr.FragStructs, *tr.Variants, tr.store})
+		*tr.FragStructs = nil
+		*tr.Variants = nil
+		*b.used -= b.sizes[tr.id]
+		delete(b.sizes, tr.id)
+		b.spilling[tr.id] = true
+		*b.spills++
+	}
+	return victims
+}
+
+// Write evicted tables to the store:
+func (b MemBudget) spill(victims []spilledTable) {
+	for _, v := range victims {
+		v.store.Put(v.id, v.frags, v.vars)
+		b.lock.Lock()
+		delete(b.spilling, v.id)
+		b.cond.Broadcast()
+		b.lock.Unlock()
+	}
+}
+
+func (b MemBudget) LogUsage() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	L.PrintfV("Estimated peak memory used by fragment tables: %d bytes, tables spilled to disk: %d, heap in use: %d bytes", *b.peak, *b.spills, ms.HeapInuse)
+}
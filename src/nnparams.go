@@ -0,0 +1,361 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Nearest-neighbour thermodynamic parameter set. Enthalpies are in kcal/mol,
+// entropies in cal/(K*mol). Doublets are keyed by the template sequence.
+type NNParams struct {
+	Name   string
+	DH     map[string]float64
+	DS     map[string]float64
+	MmDH   map[string]float64
+	MmDS   map[string]float64
+	InitH  float64
+	InitS  float64
+	TermAH float64 // Terminal A/T penalty.
+	TermAS float64
+	SymS   float64 // Symmetry correction.
+}
+
+func newNNParams(name string) *NNParams {
+	p := new(NNParams)
+	p.Name = name
+	p.DH = make(map[string]float64)
+	p.DS = make(map[string]float64)
+	p.MmDH = make(map[string]float64)
+	p.MmDS = make(map[string]float64)
+	return p
+}
+
+// Get a built-in parameter set or load it from a file:
+func GetNNParams(name string, maxMismatch int) *NNParams {
+	switch name {
+	case "santalucia2004":
+		return NNParamsSantaLucia2004()
+	case "sugimoto1995":
+		return NNParamsSugimoto1995()
+	}
+	return LoadNNParams(name, maxMismatch)
+}
+
+// DNA/DNA doublet parameters from:
+// SantaLucia and Hicks(2004) The thermodynamics of DNA structural motifs - Annu Rev.Biophys. Biomol. Struct. 33:415-440
+func NNParamsSantaLucia2004() *NNParams {
+	p := newNNParams("santalucia2004")
+	p.DH = map[string]float64{
+		"AA": -7.6,
+		"TT": -7.6,
+		"AG": -7.8,
+		"CT": -7.8,
+		"AC": -8.4,
+		"GT": -8.4,
+		"GA": -8.2,
+		"TC": -8.2,
+		"GG": -8.0,
+		"CC": -8.0,
+		"TG": -8.5,
+		"CA": -8.5,
+		"CG": -10.6,
+		"GC": -9.8,
+		"AT": -7.2,
+		"TA": -7.2,
+	}
+
+	p.DS = map[string]float64{
+		"AA": -21.3,
+		"TT": -21.3,
+		"AG": -21.0,
+		"CT": -21.0,
+		"AC": -22.4,
+		"GT": -22.4,
+		"GA": -22.2,
+		"TC": -22.2,
+		"GG": -19.9,
+		"CC": -19.9,
+		"TG": -22.7,
+		"CA": -22.7,
+		"CG": -27.2,
+		"GC": -24.4,
+		"AT": -20.4,
+		"TA": -21.3,
+	}
+
+	// Initiation:
+	p.InitH = +0.2
+	p.InitS = -5.7
+
+	// Terminal AT penalty:
+	p.TermAH = +2.2
+	p.TermAS = +6.9
+
+	// Symmetry correction for entropy:
+	p.SymS = -1.4
+
+	// Single mismatches:
+	p.MmDH, p.MmDS = mismatchParamsAllawi1998()
+	return p
+}
+
+// RNA/DNA hybrid doublet parameters (RNA template, written as DNA) from:
+// Sugimoto et al.(1995) Thermodynamic parameters to predict stability of RNA/DNA hybrid duplexes - Biochemistry 34:11211-11216
+func NNParamsSugimoto1995() *NNParams {
+	p := newNNParams("sugimoto1995")
+	p.DH = map[string]float64{
+		"AA": -7.8,
+		"AC": -5.9,
+		"AG": -9.1,
+		"AT": -8.3,
+		"CA": -9.0,
+		"CC": -9.3,
+		"CG": -16.3,
+		"CT": -7.0,
+		"GA": -5.5,
+		"GC": -8.0,
+		"GG": -12.8,
+		"GT": -7.8,
+		"TA": -7.8,
+		"TC": -8.6,
+		"TG": -10.4,
+		"TT": -11.5,
+	}
+
+	p.DS = map[string]float64{
+		"AA": -21.9,
+		"AC": -12.3,
+		"AG": -23.5,
+		"AT": -23.9,
+		"CA": -26.1,
+		"CC": -23.2,
+		"CG": -47.1,
+		"CT": -19.7,
+		"GA": -13.5,
+		"GC": -17.1,
+		"GG": -31.9,
+		"GT": -21.6,
+		"TA": -23.2,
+		"TC": -22.9,
+		"TG": -28.4,
+		"TT": -36.4,
+	}
+
+	// Initiation:
+	p.InitH = +1.9
+	p.InitS = -3.9
+
+	// Single mismatches: no complete nearest-neighbour table is available for hybrids (Sugimoto et al.(2000)
+	// Biochemistry 39:11270-11281 only measured mismatches in a fixed context), so the DNA/DNA
+	// parameters are used as an approximation.
+	p.MmDH, p.MmDS = mismatchParamsAllawi1998()
+	return p
+}
+
+// Internal single mismatch doublet parameters for DNA/DNA duplexes, keyed as "template/primer"
+// with the primer written 3'->5' (e.g. "AG/TT" is a G.T mismatch), from:
+// Allawi and SantaLucia(1997-1998) Biochemistry 36:10581-10594, 37:2170-2179, 37:9435-9444; Nucleic Acids Res. 26:2694-2701
+// as compiled in SantaLucia and Hicks(2004).
+func mismatchParamsAllawi1998() (dH map[string]float64, dS map[string]float64) {
+	dH = map[string]float64{
+		// G.T:
+		"AG/TT": +1.0,
+		"AT/TG": -2.5,
+		"CG/GT": -4.1,
+		"CT/GG": -2.8,
+		"GG/CT": +3.3,
+		"GT/CG": -4.4,
+		"TG/AT": -0.1,
+		"TT/AG": -1.3,
+		"GG/TT": +5.8,
+		"GT/TG": +4.1,
+		"TG/GT": -1.4,
+		// G.A:
+		"AA/TG": -0.6,
+		"AG/TA": -0.7,
+		"CA/GG": -0.7,
+		"CG/GA": -4.0,
+		"GA/CG": -0.6,
+		"GG/CA": +0.5,
+		"TA/AG": +0.7,
+		"TG/AA": +3.0,
+		// C.T:
+		"AC/TT": +0.7,
+		"AT/TC": -1.2,
+		"CC/GT": -0.8,
+		"CT/GC": -1.5,
+		"GC/CT": +2.3,
+		"GT/CC": +5.2,
+		"TC/AT": +1.2,
+		"TT/AC": +1.0,
+		// A.C:
+		"AA/TC": +2.3,
+		"AC/TA": +5.3,
+		"CA/GC": +1.9,
+		"CC/GA": +0.6,
+		"GA/CC": +5.2,
+		"GC/CA": -0.7,
+		"TA/AC": +3.4,
+		"TC/AA": +7.6,
+		// A.A, C.C, G.G and T.T:
+		"AA/TA": +1.2,
+		"CA/GA": -0.9,
+		"GA/CA": -2.9,
+		"TA/AA": +4.7,
+		"AC/TC": 0.0,
+		"CC/GC": -1.5,
+		"GC/CC": +3.6,
+		"TC/AC": +6.1,
+		"AG/TG": -3.1,
+		"CG/GG": -4.9,
+		"GG/CG": -6.0,
+		"TG/AG": +1.6,
+		"AT/TT": -2.7,
+		"CT/GT": -5.0,
+		"GT/CT": -2.2,
+		"TT/AT": +0.2,
+	}
+	dS = map[string]float64{
+		// G.T:
+		"AG/TT": +0.9,
+		"AT/TG": -8.3,
+		"CG/GT": -11.7,
+		"CT/GG": -8.0,
+		"GG/CT": +10.4,
+		"GT/CG": -12.3,
+		"TG/AT": -1.7,
+		"TT/AG": -5.3,
+		"GG/TT": +16.3,
+		"GT/TG": +9.5,
+		"TG/GT": -6.2,
+		// G.A:
+		"AA/TG": -2.3,
+		"AG/TA": -2.3,
+		"CA/GG": -2.3,
+		"CG/GA": -13.2,
+		"GA/CG": -1.0,
+		"GG/CA": +3.2,
+		"TA/AG": +0.7,
+		"TG/AA": +7.4,
+		// C.T:
+		"AC/TT": +0.2,
+		"AT/TC": -6.2,
+		"CC/GT": -4.5,
+		"CT/GC": -6.1,
+		"GC/CT": +5.4,
+		"GT/CC": +13.5,
+		"TC/AT": +0.7,
+		"TT/AC": +0.7,
+		// A.C:
+		"AA/TC": +4.6,
+		"AC/TA": +14.6,
+		"CA/GC": +3.7,
+		"CC/GA": -0.6,
+		"GA/CC": +14.2,
+		"GC/CA": -3.8,
+		"TA/AC": +8.0,
+		"TC/AA": +20.2,
+		// A.A, C.C, G.G and T.T:
+		"AA/TA": +1.7,
+		"CA/GA": -4.2,
+		"GA/CA": -9.8,
+		"TA/AA": +12.9,
+		"AC/TC": -4.4,
+		"CC/GC": -7.2,
+		"GC/CC": +8.9,
+		"TC/AC": +16.4,
+		"AG/TG": -9.5,
+		"CG/GG": -15.3,
+		"GG/CG": -15.8,
+		"TG/AG": +3.6,
+		"AT/TT": -10.8,
+		"CT/GT": -15.8,
+		"GT/CT": -8.4,
+		"TT/AT": -1.5,
+	}
+	return
+}
+
+// Load parameter set from a file. The file has whitespace separated
+// columns: key, enthalpy and entropy. Keys are "init", "term_at", "symmetry",
+// doublets (e.g. "AG") or doublets with mismatches (e.g. "AG/TT").
+// Lines starting with '#' are ignored.
+func LoadNNParams(file string, maxMismatch int) *NNParams {
+	f, err := os.Open(file)
+	if err != nil {
+		L.Fatalf("Could not open nearest-neighbour parameter file \"%s\": %s", file, err.Error())
+	}
+	defer f.Close()
+	p := newNNParams(file)
+
+	scanner := bufio.NewScanner(f)
+	lineNr := 0
+	for scanner.Scan() {
+		lineNr++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		var key string
+		var dH, dS float64
+		n, err := fmt.Sscanf(line, "%s %f %f", &key, &dH, &dS)
+		if n != 3 || err != nil {
+			L.Fatalf("Malformed line %d in nearest-neighbour parameter file \"%s\": %s", lineNr, file, line)
+		}
+		key = strings.ToUpper(key)
+		switch {
+		case key == "INIT":
+			p.InitH, p.InitS = dH, dS
+		case key == "TERM_AT":
+			p.TermAH, p.TermAS = dH, dS
+		case key == "SYMMETRY":
+			p.SymS = dS
+		case len(key) == 2:
+			p.DH[key], p.DS[key] = dH, dS
+		case len(key) == 5 && key[2] == '/':
+			p.MmDH[key], p.MmDS[key] = dH, dS
+		default:
+			L.Fatalf("Invalid key \"%s\" in nearest-neighbour parameter file \"%s\"!", key, file)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		L.Fatalf("Error when reading nearest-neighbour parameter file \"%s\": %s", file, err.Error())
+	}
+	if len(p.DH) != 16 {
+		L.Fatalf("Nearest-neighbour parameter file \"%s\" must specify all 16 doublets!", file)
+	}
+	if maxMismatch > 0 && len(p.MmDH) == 0 {
+		L.Printf("WARNING: No mismatch doublets in nearest-neighbour parameter file \"%s\", only perfectly matching primers bind!\n", file)
+	}
+	return p
+}
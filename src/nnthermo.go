@@ -29,13 +29,18 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"math"
+	"os"
+	"sync"
 )
 
 type Primer interface {
 	GetBindingProfile(tr Transcripter, reverse bool) BindingProfile
 	GetBindingProfiles(tr Transcripter, rev bool) *BindingProfiles
-	SimulatePriming(profile BindingProfile, start uint32, end uint32, rand Rander) uint32
+	SimulatePriming(profile BindingProfile, start uint32, end uint32, rand Rander) (uint32, bool)
+	SampleBindingSite(seq *PackedSeq, pos uint32, rand Rander) string
 	JettisonCache()
 	GetKmerLength() uint32
 }
@@ -43,183 +48,401 @@ type Primer interface {
 type NNthermo struct {
 	nn_dS        map[string]float64
 	nn_dH        map[string]float64
-	kmerCache    *map[string]float64
+	mm_dS        map[string]float64
+	mm_dH        map[string]float64
+	kmerCache    *map[string]float64 // Affinities of k-mers containing ambiguous bases.
+	cacheLock    *sync.Mutex
+	affTable     *[]float64 // Affinities of all k-mers, indexed by the packed k-mer.
 	kmerLength   uint32
+	maxMismatch  int
 	initiation_H float64
 	initiation_S float64
 	termAT_H     float64
 	termAT_S     float64
 	symmetry_S   float64
+	salt_S       float64
+	primerPool   *PrimerPool // Primer concentrations, nil for a uniform pool.
 	T            float64
+	celsius      bool // Temperature is on the Kelvin scale, energies are converted to cal/mol.
 }
 
 type BindingProfile []float64
 
 type BindingProfiles struct {
-	Forward BindingProfile
-	Reverse BindingProfile
+	Forward    BindingProfile
+	Reverse    BindingProfile
+	ForwardSeq *PackedSeq
+	ReverseSeq *PackedSeq
 }
 
-func NewNNthermo(primingTemp float64, kmerLength uint32) *NNthermo {
+// Maximum k-mer length for which the dense affinity table is precomputed:
+const maxTableKmer = 12
+
+func NewNNthermo(p *PrimingParam) *NNthermo {
 	nn := new(NNthermo)
 
-	// Doublet binding enerigies from:
-	// SantaLucia and Hicks(2004) The thermodynamics of DNA structural motifs - Annu Rev.Biophys. Biomol. Struct. 33:415-440
-	nn.nn_dH = map[string]float64{
-		"AA": -7.6,
-		"TT": -7.6,
-		"AG": -7.8,
-		"CT": -7.8,
-		"AC": -8.4,
-		"GT": -8.4,
-		"GA": -8.2,
-		"TC": -8.2,
-		"GG": -8.0,
-		"CC": -8.0,
-		"TG": -8.5,
-		"CA": -8.5,
-		"CG": -10.6,
-		"GC": -9.8,
-		"AT": -7.2,
-		"TA": -7.2,
-	}
-
-	nn.nn_dS = map[string]float64{
-		"AA": -21.3,
-		"TT": -21.3,
-		"AG": -21.0,
-		"CT": -21.0,
-		"AC": -22.4,
-		"GT": -22.4,
-		"GA": -22.2,
-		"TC": -22.2,
-		"GG": -19.9,
-		"CC": -19.9,
-		"TG": -22.7,
-		"CA": -22.7,
-		"CG": -27.2,
-		"GC": -24.4,
-		"AT": -20.4,
-		"TA": -21.3,
-	}
+	// Load nearest-neighbour parameters:
+	params := GetNNParams(p.NNSet, p.MaxMismatch)
+	L.PrintfV("Nearest-neighbour parameter set: %s", params.Name)
+	nn.nn_dH = params.DH
+	nn.nn_dS = params.DS
+
+	// Doublets containing a single mismatch, keyed as "template/primer" with the primer
+	// written 3'->5' (e.g. "AG/TT" is a G.T mismatch), and looked up in both orientations.
+	// Primers forming doublets missing from these tables (such as most adjacent mismatches)
+	// are not considered to bind.
+	nn.mm_dH = params.MmDH
+	nn.mm_dS = params.MmDS
 
 	// Initialize kmer cache:
 	hexTmp := make(map[string]float64, 1296)
 	nn.kmerCache = &hexTmp
+	nn.cacheLock = new(sync.Mutex)
 
 	// Initialize other parameters:
-	nn.initiation_H = +0.2
-	nn.initiation_S = -5.7
+	nn.initiation_H = params.InitH
+	nn.initiation_S = params.InitS
 
 	// Terminal AT penalty:
-	nn.termAT_H = +2.2
-	nn.termAT_S = +6.9
+	nn.termAT_H = params.TermAH
+	nn.termAT_S = params.TermAS
 
 	// Symmetry correction for entropy:
-	nn.symmetry_S = -1.4
+	nn.symmetry_S = params.SymS
 
-	nn.T = primingTemp
-	nn.kmerLength = kmerLength
+	nn.kmerLength = p.KmerLength
+	nn.maxMismatch = p.MaxMismatch
+	if nn.maxMismatch > 0 {
+		L.PrintfV("Maximum number of primer mismatches: %d", nn.maxMismatch)
+	}
+
+	// Load primer concentrations:
+	if p.PrimerFile != "" {
+		nn.primerPool = LoadPrimerPool(p.PrimerFile, nn.kmerLength)
+		L.PrintfV("Loaded %d primers from %s.", len(nn.primerPool.Conc), p.PrimerFile)
+	}
+
+	// Set temperature:
+	if p.Celsius {
+		nn.T = p.TempC + 273.15
+		nn.celsius = true
+		L.PrintfV("Priming temperature: %g C", p.TempC)
+	} else {
+		nn.T = p.Temp
+	}
+
+	// Salt correction of entropy (SantaLucia 1998), with Mg2+ converted to
+	// Na+ equivalents as in von Ahsen et al.(2001):
+	naEq := (p.Na + 120.0*math.Sqrt(p.Mg)) / 1000.0
+	if naEq <= 0 {
+		L.Fatalf("The monovalent salt concentration must be positive!")
+	}
+	nn.salt_S = 0.368 * float64(nn.kmerLength-1) * math.Log(naEq)
+	if nn.salt_S != 0.0 {
+		L.PrintfV("Salt correction: [Na+] = %g mM, [Mg2+] = %g mM", p.Na, p.Mg)
+	}
+
+	// Precompute the affinities of all k-mers:
+	if nn.kmerLength <= maxTableKmer {
+		nn.affTable = nn.AffinityTable()
+	}
+
+	// Export affinities:
+	if p.AffinityFile != "" {
+		nn.ExportAffinities(p.AffinityFile)
+	}
 	return nn
 }
 
+// Total affinity of the primer pool to a template k-mer:
 func (nn NNthermo) KmerAffinity(kmer string) float64 {
 	// Check in k-mer cache:
+	nn.cacheLock.Lock()
 	ce, ok := (*nn.kmerCache)[kmer]
+	nn.cacheLock.Unlock()
 	if ok {
 		return ce
 	}
+	k := nn.kmerAffinity(kmer)
+
+	// Store in cache:
+	nn.cacheLock.Lock()
+	(*nn.kmerCache)[kmer] = k
+	nn.cacheLock.Unlock()
+	return k
+}
+
+// Calculate the affinities of all k-mers:
+func (nn NNthermo) AffinityTable() *[]float64 {
+	table := make([]float64, uint64(1)<<(2*nn.kmerLength))
+	for i := range table {
+		table[i] = nn.kmerAffinity(DecodeKmer(uint64(i), nn.kmerLength))
+	}
+	return &table
+}
+
+// Affinity of the primer pool to a template k-mer, without caching:
+func (nn NNthermo) kmerAffinity(kmer string) float64 {
+	var k float64
+	if nn.maxMismatch == 0 {
+		k = nn.WeightedAffinity(kmer, kmer)
+	} else {
+		// Sum up the affinities of all primers binding with tolerated mismatches:
+		for _, site := range nn.BindingSites(kmer) {
+			k += nn.WeightedAffinity(site, kmer)
+		}
+	}
+	return k
+}
+
+// Affinity of the primer perfectly matching site to the template k-mer, weighted by the concentration of the primer:
+func (nn NNthermo) WeightedAffinity(site string, kmer string) float64 {
+	if nn.primerPool == nil {
+		return nn.PairAffinity(site, kmer)
+	}
+	c := nn.primerPool.SiteConc(site)
+	if c == 0.0 {
+		return 0.0
+	}
+	return c * nn.PairAffinity(site, kmer)
+}
+
+// Affinity of the primer perfectly matching site to the template k-mer:
+func (nn NNthermo) PairAffinity(site string, kmer string) float64 {
+	dH, dS := nn.PairEnthalpyEntropy(site, kmer)
+
+	// Calculate free energy change:
+	e := dH - (nn.T*dS)/1000.0
+	if nn.celsius {
+		return math.Exp(-e * 1000.0 / (1.9872 * nn.T))
+	}
+	// Calculate equlibrium constant:
+	return math.Exp(-e / (1.9872 * nn.T))
+}
 
+// Enthalpy and entropy change of the binding of the primer perfectly matching site to the template k-mer:
+func (nn NNthermo) PairEnthalpyEntropy(site string, kmer string) (dH float64, dS float64) {
 	// Initialize:
 	kl := len(kmer)
-	dH := nn.initiation_H
-	dS := nn.initiation_S
+	dH = nn.initiation_H
+	dS = nn.initiation_S + nn.salt_S
 
 	// Sum up doublet energies:
 	for i := 0; i <= kl-2; i++ {
 		doublet := kmer[i : i+2]
-		dH += nn.nn_dH[doublet]
-		dS += nn.nn_dS[doublet]
+		if site[i] == kmer[i] && site[i+1] == kmer[i+1] {
+			dH += nn.nn_dH[doublet]
+			dS += nn.nn_dS[doublet]
+			continue
+		}
+		// Doublet containing a mismatch:
+		mm := doublet + "/" + complementBase(site[i]) + complementBase(site[i+1])
+		mH, mS, ok := nn.mismatchEnergy(mm)
+		if !ok {
+			L.Fatalf("No nearest-neighbour parameters for the mismatch doublet \"%s\"!", mm)
+		}
+		dH += mH
+		dS += mS
 	}
 	// Terminal A/T penalties:
-	if kmer[0] == 'A' || kmer[0] == 'T' {
+	if site[0] == kmer[0] && (kmer[0] == 'A' || kmer[0] == 'T') {
 		dH += nn.termAT_H
 		dS += nn.termAT_S
 	}
-	if kmer[kl-1] == 'A' || kmer[kl-1] == 'T' {
+	if site[kl-1] == kmer[kl-1] && (kmer[kl-1] == 'A' || kmer[kl-1] == 'T') {
 		dH += nn.termAT_H
 		dS += nn.termAT_S
 	}
 
 	// Symmetry correction:
-	sym := true
-	for j := 0; j <= int(kl/2); j++ {
+	sym := site == kmer
+	for j := 0; sym && j <= int(kl/2); j++ {
 		if kmer[j] != kmer[kl-j-1] {
 			sym = false
-			break
 		}
 	}
 	if sym {
 		dS += nn.symmetry_S
 		// No symmetry correction for enthalpy.
 	}
+	return
+}
 
-	// Calculate free energy change:
-	e := dH - (nn.T*dS)/1000.0
-	// Calculate equlibrium constant:
-	k := math.Exp(-e / (1.9872 * nn.T))
+// Enthalpy and entropy change of a doublet containing a mismatch, looked up as given
+// and rotated by 180 degrees (e.g. "AG/TT" is the same stack as "TT/GA"):
+func (nn NNthermo) mismatchEnergy(mm string) (dH float64, dS float64, ok bool) {
+	if dH, ok = nn.mm_dH[mm]; ok {
+		return dH, nn.mm_dS[mm], true
+	}
+	rot := string([]byte{mm[4], mm[3], '/', mm[1], mm[0]})
+	if dH, ok = nn.mm_dH[rot]; ok {
+		return dH, nn.mm_dS[rot], true
+	}
+	return 0.0, 0.0, false
+}
 
-	// Store in cache:
-	(*nn.kmerCache)[kmer] = k
-	return k
+// Check whether all doublets of a site containing mismatches have parameters:
+func (nn NNthermo) hasMismatchParams(site []byte, kmer string) bool {
+	for i := 0; i < len(kmer)-1; i++ {
+		if site[i] == kmer[i] && site[i+1] == kmer[i+1] {
+			continue
+		}
+		mm := kmer[i:i+2] + "/" + complementBase(site[i]) + complementBase(site[i+1])
+		if _, _, ok := nn.mismatchEnergy(mm); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Enumerate the sites of primers able to bind to a template k-mer (including the perfect match).
+// Sites with mismatch doublets lacking parameters are skipped, together with their further mutants:
+func (nn NNthermo) BindingSites(kmer string) []string {
+	sites := []string{kmer}
+	var mutate func(site []byte, from int, left int)
+	mutate = func(site []byte, from int, left int) {
+		if left == 0 {
+			return
+		}
+		for i := from; i < len(site); i++ {
+			orig := site[i]
+			for _, b := range []byte("ACGT") {
+				if b == orig {
+					continue
+				}
+				site[i] = b
+				if !nn.hasMismatchParams(site, kmer) {
+					continue
+				}
+				sites = append(sites, string(site))
+				mutate(site, i+1, left-1)
+			}
+			site[i] = orig
+		}
+	}
+	mutate([]byte(kmer), 0, nn.maxMismatch)
+	return sites
+}
+
+// Sample the site of the primer which bound at a given position. Returns an empty string
+// in the case of a perfect match, otherwise the site matching the primer in the orientation
+// of the primed strand.
+func (nn NNthermo) SampleBindingSite(seq *PackedSeq, pos uint32, rand Rander) string {
+	if nn.maxMismatch == 0 {
+		return ""
+	}
+	if pos+nn.kmerLength > seq.Len {
+		return ""
+	}
+	kmer := seq.Sub(pos, pos+nn.kmerLength)
+	sites := nn.BindingSites(kmer)
+	p := make([]float64, len(sites))
+	for i, site := range sites {
+		p[i] = nn.WeightedAffinity(site, kmer)
+	}
+	ind, ok := rand.SampleIndexFloat64(p)
+	if !ok || sites[ind] == kmer {
+		return ""
+	}
+	return sites[ind]
 }
 
 func (nn NNthermo) GetBindingProfiles(tr Transcripter, rev bool) *BindingProfiles {
 	bp := new(BindingProfiles)
-	bp.Forward = nn.GetBindingProfile(tr, false)
+	bp.ForwardSeq = tr.GetPackedSeq(false)
+	bp.Forward = nn.PackedBindingProfile(bp.ForwardSeq)
 	if rev {
-		bp.Reverse = nn.GetBindingProfile(tr, true)
+		bp.ReverseSeq = tr.GetPackedSeq(true)
+		bp.Reverse = nn.PackedBindingProfile(bp.ReverseSeq)
 	}
 	return bp
 }
 
 func (nn NNthermo) GetBindingProfile(tr Transcripter, reverse bool) BindingProfile {
-	var seq string
-	if !reverse {
-		seq = tr.GetSeq()
-	} else {
-		seq = tr.GetRevSeq()
+	return nn.PackedBindingProfile(tr.GetPackedSeq(reverse))
+}
+
+// Binding profile of a packed sequence:
+func (nn NNthermo) PackedBindingProfile(seq *PackedSeq) BindingProfile {
+	if seq.Len < nn.kmerLength {
+		return BindingProfile{}
 	}
-	profLen := tr.GetLen() - nn.kmerLength
+	profLen := seq.Len - nn.kmerLength
 	p := make(BindingProfile, profLen)
 
-	for i := uint32(0); i < profLen; i++ {
-		end := i + nn.kmerLength
-		p[i] = nn.KmerAffinity(seq[i:end])
+	if nn.affTable == nil {
+		for i := uint32(0); i < profLen; i++ {
+			p[i] = nn.KmerAffinity(seq.Sub(i, i+nn.kmerLength))
+		}
+		return p
 	}
+	table := *nn.affTable
+	seq.RollKmers(nn.kmerLength, profLen, func(pos uint32, idx uint64, valid bool) {
+		if valid {
+			p[pos] = table[idx]
+			return
+		}
+		// Fall back to the slow path for k-mers with ambiguous bases:
+		p[pos] = nn.KmerAffinity(seq.Sub(pos, pos+nn.kmerLength))
+	})
 	return p
 }
 
-func (nn NNthermo) SimulatePriming(profile BindingProfile, start uint32, end uint32, rand Rander) uint32 {
+// Sample a priming position from the interval [start, end) of the profile.
+// Returns false if no primer can bind in the interval.
+func (nn NNthermo) SimulatePriming(profile BindingProfile, start uint32, end uint32, rand Rander) (uint32, bool) {
 	profLen := uint32(len(profile))
 	if end > profLen {
 		end = profLen
 	}
 	if start >= end {
-		return 0
+		return 0, true
 	}
 	p := profile[start:end]
 	ind, ok := rand.SampleIndexFloat64(p)
 	if !ok {
-		L.Fatalf("Error when simulating priming!\n")
+		if nn.primerPool == nil {
+			L.Fatalf("Error when simulating priming!\n")
+		}
+		return 0, false
 	}
-	return (uint32(ind) + start)
+	return (uint32(ind) + start), true
 }
 
 func (nn NNthermo) JettisonCache() {
 	*nn.kmerCache = nil
+	if nn.affTable != nil {
+		*nn.affTable = nil
+	}
 }
 
 func (nn NNthermo) GetKmerLength() uint32 {
 	return nn.kmerLength
 }
+
+// Write out the binding affinities of all k-mers:
+func (nn NNthermo) ExportAffinities(file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		L.Fatalf("Could not create affinity file \"%s\": %s", file, err.Error())
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "kmer\tdH\tdS\tdG\taffinity\n")
+	nrKmers := uint64(1) << (2 * nn.kmerLength)
+	for i := uint64(0); i < nrKmers; i++ {
+		s := DecodeKmer(i, nn.kmerLength)
+		dH, dS := nn.PairEnthalpyEntropy(s, s)
+		dG := dH - (nn.T*dS)/1000.0
+		var k float64
+		if nn.affTable != nil {
+			k = (*nn.affTable)[i]
+		} else {
+			k = nn.KmerAffinity(s)
+		}
+		fmt.Fprintf(w, "%s\t%g\t%g\t%g\t%g\n", s, dH, dS, dG, k)
+	}
+	L.PrintfV("Binding affinities written to %s.", file)
+}
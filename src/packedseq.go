@@ -0,0 +1,136 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+// Nucleotides packed into two bits (A=0, C=1, G=2, T=3), 32 bases per word.
+// Bases other than A, C, G and T are flagged in a separate mask.
+type PackedSeq struct {
+	Words []uint64
+	NMask []uint64
+	Len   uint32
+}
+
+const packedBases = "ACGT"
+
+// Two-bit code of a nucleotide:
+func baseCode(b byte) (uint64, bool) {
+	switch b {
+	case 'A':
+		return 0, true
+	case 'C':
+		return 1, true
+	case 'G':
+		return 2, true
+	case 'T':
+		return 3, true
+	}
+	return 0, false
+}
+
+// Pack a DNA sequence:
+func PackDNA(seq string) *PackedSeq {
+	n := (len(seq) + 31) / 32
+	ps := &PackedSeq{Words: make([]uint64, n), NMask: make([]uint64, (len(seq)+63)/64), Len: uint32(len(seq))}
+	for i := 0; i < len(seq); i++ {
+		c, ok := baseCode(seq[i])
+		if !ok {
+			ps.NMask[i/64] |= 1 << uint(i%64)
+		}
+		ps.Words[i/32] |= c << (2 * uint(i%32))
+	}
+	return ps
+}
+
+// Two-bit code of the base at position i and false if the base is ambiguous:
+func (ps PackedSeq) Code(i uint32) (uint64, bool) {
+	if ps.NMask[i/64]&(1<<(i%64)) != 0 {
+		return 0, false
+	}
+	return (ps.Words[i/32] >> (2 * (i % 32))) & 3, true
+}
+
+// Base at position i:
+func (ps PackedSeq) Base(i uint32) byte {
+	c, ok := ps.Code(i)
+	if !ok {
+		return 'N'
+	}
+	return packedBases[c]
+}
+
+// Unpack the subsequence [start, end):
+func (ps PackedSeq) Sub(start uint32, end uint32) string {
+	tmp := make([]byte, end-start)
+	for i := start; i < end; i++ {
+		tmp[i-start] = ps.Base(i)
+	}
+	return string(tmp)
+}
+
+// Index of the k-mer starting at position pos and false if it contains ambiguous bases:
+func (ps PackedSeq) KmerIndex(pos uint32, k uint32) (uint64, bool) {
+	var idx uint64
+	for i := pos; i < pos+k; i++ {
+		c, ok := ps.Code(i)
+		if !ok {
+			return 0, false
+		}
+		idx = (idx << 2) | c
+	}
+	return idx, true
+}
+
+// Call f with the rolling index of every k-mer starting in [0, n). The
+// index is not valid for k-mers containing ambiguous bases.
+func (ps PackedSeq) RollKmers(k uint32, n uint32, f func(pos uint32, idx uint64, valid bool)) {
+	mask := uint64(1)<<(2*k) - 1
+	var idx uint64
+	var lastN int64 = -1
+	for i := uint32(0); i < n+k-1 && i < ps.Len; i++ {
+		c, ok := ps.Code(i)
+		if !ok {
+			lastN = int64(i)
+		}
+		idx = ((idx << 2) | c) & mask
+		if i+1 < k {
+			continue
+		}
+		pos := i + 1 - k
+		f(pos, idx, int64(pos) > lastN)
+	}
+}
+
+// Decode a k-mer index:
+func DecodeKmer(idx uint64, k uint32) string {
+	kmer := make([]byte, k)
+	for j := uint32(0); j < k; j++ {
+		kmer[k-1-j] = packedBases[(idx>>(2*j))&3]
+	}
+	return string(kmer)
+}
@@ -46,6 +46,9 @@ type RawParams struct {
 	NrCycles    int64
 	TargetProbs LenProbStruct
 	GcEffs      []float64
+	GcModel     string
+	GcWindow    int
+	GcLenEffs   *EffSurface
 }
 
 func DecodeRawParams(fname string) *RawParams {
@@ -123,5 +126,52 @@ func DecodeRawParams(fname string) *RawParams {
 	}
 	res.GcEffs = gcSlice
 
+	// optional gc efficiency model
+	if model_raw, ok := d["gc_model"]; ok {
+		res.GcModel = model_raw.(string)
+	}
+	if window_raw, ok := d["gc_window"]; ok {
+		res.GcWindow = int(window_raw.(float64))
+	}
+
+	// optional joint gc and length efficiencies
+	if surf_raw, ok := d["gc_len_eff"]; ok {
+		res.GcLenEffs = decodeEffSurface(surf_raw)
+	}
+
 	return res
 }
+
+// Decode a joint efficiency table: {"gc": [...], "length": [...], "eff": [[...], ...]}
+func decodeEffSurface(raw interface{}) *EffSurface {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		L.Fatalf("The gc_len_eff value must be an object!")
+	}
+	floats := func(v interface{}, key string) []float64 {
+		s, ok := v.([]interface{})
+		if !ok {
+			L.Fatalf("The gc_len_eff key %s must be an array!", key)
+		}
+		res := make([]float64, len(s))
+		for i, x := range s {
+			f, ok := x.(float64)
+			if !ok {
+				L.Fatalf("Invalid number in gc_len_eff key %s!", key)
+			}
+			res[i] = f
+		}
+		return res
+	}
+	gc := floats(m["gc"], "gc")
+	length := floats(m["length"], "length")
+	rows, ok := m["eff"].([]interface{})
+	if !ok {
+		L.Fatalf("The gc_len_eff key eff must be an array of rows!")
+	}
+	eff := make([][]float64, len(rows))
+	for i, row := range rows {
+		eff[i] = floats(row, "eff")
+	}
+	return NewEffSurface(gc, length, eff)
+}
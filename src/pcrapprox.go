@@ -0,0 +1,122 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const approxCmpReps = 200
+
+// Draw the number of molecules after k cycles from the normal approximation of
+// the branching process started from n molecules amplified with efficiency e:
+func (tn Techne) ApproxAmplify(n uint64, e float64, k int64, rand Rander) uint64 {
+	mu := 1.0 + e
+	muk := math.Pow(mu, float64(k))
+	mean := float64(n) * muk
+	// Variance of the offspring is e(1-e):
+	v := float64(n) * (1.0 - e) * (muk / mu) * (muk - 1.0)
+	x := math.Floor(mean + math.Sqrt(v)*rand.NormFloat64() + 0.5)
+	if x < float64(n) {
+		x = float64(n)
+	}
+	if x >= math.MaxUint64 {
+		L.Fatal("Integer overflow detected when amplifying fragments!")
+	}
+	return uint64(x)
+}
+
+// Number of copies made in a single cycle, approximated by a normal
+// variate above the threshold:
+func (tn Techne) DrawCopies(n uint64, e float64, rand Rander) uint64 {
+	if tn.ApproxThreshold == 0 || n < tn.ApproxThreshold {
+		return rand.Binomial(n, e)
+	}
+	x := math.Floor(float64(n)*e + math.Sqrt(float64(n)*e*(1.0-e))*rand.NormFloat64() + 0.5)
+	if x < 0.0 {
+		return 0
+	}
+	if x > float64(n) {
+		return n
+	}
+	return uint64(x)
+}
+
+// Compare the final counts simulated by the exact and the approximate paths:
+func (tn Techne) CompareApprox(rep Reporter, rand Rander) {
+	if tn.ApproxThreshold == 0 {
+		L.Fatalf("Comparing the approximate PCR requires a positive threshold!")
+	}
+	res := make(map[string]float64)
+	var exactTime, approxTime time.Duration
+	for _, n := range []uint64{tn.ApproxThreshold, 10 * tn.ApproxThreshold} {
+		for _, e := range []float64{0.5, 0.8, 0.95} {
+			exact := make([]float64, approxCmpReps)
+			approx := make([]float64, approxCmpReps)
+			t := time.Now()
+			for r := 0; r < approxCmpReps; r++ {
+				c := n
+				for i := int64(0); i < tn.NrCycles; i++ {
+					c += rand.Binomial(c, e)
+				}
+				exact[r] = float64(c)
+			}
+			exactTime += time.Since(t)
+			t = time.Now()
+			for r := 0; r < approxCmpReps; r++ {
+				approx[r] = float64(tn.ApproxAmplify(n, e, tn.NrCycles, rand))
+			}
+			approxTime += time.Since(t)
+
+			me, se := meanSd(exact)
+			ma, sa := meanSd(approx)
+			key := fmt.Sprintf("n=%d e=%g", n, e)
+			res[key+" mean ratio"] = ma / me
+			res[key+" sd ratio"] = sa / se
+			L.PrintfV("Approximate PCR (%s): mean %g vs. %g, sd %g vs. %g\n", key, ma, me, sa, se)
+		}
+	}
+	res["speedup"] = float64(exactTime) / float64(approxTime)
+	L.PrintfV("Approximate PCR speedup: %g\n", res["speedup"])
+	rep.ReportMapStringf64(res, "Setting", "Approximate/exact", "Approximate PCR accuracy", "table")
+}
+
+func meanSd(x []float64) (mean float64, sd float64) {
+	for _, v := range x {
+		mean += v
+	}
+	mean /= float64(len(x))
+	for _, v := range x {
+		sd += (v - mean) * (v - mean)
+	}
+	sd = math.Sqrt(sd / float64(len(x)-1))
+	return
+}
@@ -0,0 +1,273 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const pcrChimeraTries = 20
+
+// Template switching of incompletely extended PCR products:
+type PcrChimeraModel struct {
+	Rate       float64 // Per copy and cycle.
+	MinOverlap uint32  // Homology required between the product end and the new template.
+}
+
+// Breakpoint of a PCR chimera: the first part ends before X, the second part starts
+// at Y. When the new template comes from another transcript, the part copied from it
+// is kept with the junction and its coordinates refer to the partner transcript.
+type PcrJunction struct {
+	X       uint32
+	Y       uint32
+	Partner string // Name of the partner transcript, empty within a transcript.
+	Head    bool   // The first part comes from the partner.
+	Seq     string // Sequence of the part copied from the partner.
+}
+
+func NewPcrChimeraModel(rate float64, minOverlap int) *PcrChimeraModel {
+	if rate < 0.0 || rate >= 1.0 {
+		L.Fatalf("Invalid PCR chimera rate: %g", rate)
+	}
+	if minOverlap < 1 {
+		L.Fatalf("The minimum PCR chimera overlap must be positive!")
+	}
+	m := &PcrChimeraModel{rate, uint32(minOverlap)}
+	if m.Active() {
+		L.PrintfV("PCR chimera rate per cycle: %g, minimum overlap: %d", rate, minOverlap)
+	}
+	return m
+}
+
+func (m PcrChimeraModel) Active() bool {
+	return m.Rate > 0.0
+}
+
+// Pre-PCR fragments of a transcript serving as new templates, sorted by start:
+type trTemplates struct {
+	Start  []uint32
+	End    []uint32
+	Var    []*FragVariant
+	Cum    []uint64 // Cumulative counts.
+	MaxLen uint32
+}
+
+// Position of an overlap sized k-mer in a transcript:
+type pcrSite struct {
+	Tr  uint32
+	Pos uint32
+}
+
+// Templates of the whole pool, indexed by overlap sized k-mers:
+type pcrTemplates struct {
+	trs   []Transcripter
+	frags []*trTemplates
+	kmers map[string][]pcrSite
+}
+
+func newTrTemplates(tr Transcripter) *trTemplates {
+	all := StartEndCountStruct{}
+	for _, sec := range *tr.GetFragStructs() {
+		all.Start = append(all.Start, sec.Start...)
+		all.End = append(all.End, sec.End...)
+		all.Var = append(all.Var, sec.Var...)
+		all.Count = append(all.Count, sec.Count...)
+	}
+	if len(all.Count) == 0 {
+		return nil
+	}
+	sort.Sort(all)
+
+	// The variants are copied, as the variant tables keep growing during PCR:
+	tt := &trTemplates{Start: all.Start, End: all.End, Var: make([]*FragVariant, len(all.Var)), Cum: make([]uint64, len(all.Count)+1)}
+	for i, c := range all.Count {
+		tt.Var[i] = tr.GetVariant(all.Var[i])
+		tt.Cum[i+1] = tt.Cum[i] + c
+		if l := all.End[i] - all.Start[i]; l > tt.MaxLen {
+			tt.MaxLen = l
+		}
+	}
+	return tt
+}
+
+// Index the templates of the transcripts having pre-PCR fragments:
+func newPcrTemplates(trs []Transcripter, frags []*trTemplates, k uint32) *pcrTemplates {
+	pt := &pcrTemplates{trs: trs, frags: frags, kmers: make(map[string][]pcrSite)}
+	for t, tr := range trs {
+		if frags[t] == nil {
+			continue
+		}
+		seq := tr.GetSeq()
+		for i := 0; i+int(k) <= len(seq); i++ {
+			kmer := seq[i : i+int(k)]
+			pt.kmers[kmer] = append(pt.kmers[kmer], pcrSite{uint32(t), uint32(i)})
+		}
+	}
+	return pt
+}
+
+// Sample a template covering the region [lo, hi) proportionally to its count:
+func (tt trTemplates) sampleCovering(lo uint32, hi uint32, rand Rander) (int, bool) {
+	n := len(tt.Start)
+	var first uint32
+	if hi > tt.MaxLen {
+		first = hi - tt.MaxLen
+	}
+	i0 := sort.Search(n, func(i int) bool { return tt.Start[i] >= first })
+	i1 := sort.Search(n, func(i int) bool { return tt.Start[i] > lo })
+	if i1 <= i0 {
+		return 0, false
+	}
+	total := tt.Cum[i1] - tt.Cum[i0]
+	if total == 0 {
+		return 0, false
+	}
+	for t := 0; t < pcrChimeraTries; t++ {
+		u := tt.Cum[i0] + uint64(rand.Int63n(int64(total)))
+		idx := sort.Search(n, func(i int) bool { return tt.Cum[i+1] > u })
+		if tt.End[idx] >= hi {
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+// Simulate the switch of an incompletely extended copy of a clone to a new template,
+// which can belong to any transcript of the pool. The product is extended in either
+// direction, and its end must be homologous to the new template over at least MinOverlap
+// bases. Products collinear with their source carry no junction:
+func (m PcrChimeraModel) Switch(tr Transcripter, pt *pcrTemplates, cl *pcrClone, rand Rander) (*pcrClone, bool) {
+	h := m.MinOverlap
+	if cl.end-cl.start <= h {
+		return nil, false
+	}
+	forward := rand.Float64() < 0.5
+	var p uint32
+	if forward {
+		// The product covers [start, p):
+		p = cl.start + h + uint32(rand.Int63n(int64(cl.end-cl.start-h)))
+	} else {
+		// The product covers [p, end):
+		p = cl.start + 1 + uint32(rand.Int63n(int64(cl.end-cl.start-h)))
+	}
+	var occ []pcrSite
+	if forward {
+		occ = pt.kmers[tr.SubSeq(p-h, p)]
+	} else {
+		occ = pt.kmers[tr.SubSeq(p, p+h)]
+	}
+	if len(occ) == 0 {
+		return nil, false
+	}
+
+	for t := 0; t < pcrChimeraTries; t++ {
+		site := occ[rand.Int63n(int64(len(occ)))]
+		nt, tt, s := pt.trs[site.Tr], pt.frags[site.Tr], site.Pos
+		same := nt.GetId() == tr.GetId()
+		if forward {
+			// Continue on the new template after the homologous region:
+			q := s + h
+			idx, ok := tt.sampleCovering(s, q+1, rand)
+			if !ok || (same && tt.End[idx] <= cl.start) {
+				continue
+			}
+			j := &PcrJunction{X: p, Y: q}
+			if !same {
+				j.Partner, j.Seq = nt.GetName(), nt.SubSeq(q, tt.End[idx])
+			}
+			v := &FragVariant{}
+			if !same || p != q {
+				v.Junction = j
+			}
+			if cl.variant != nil {
+				v.StartSite, v.Lineage, v.Umi = cl.variant.StartSite, cl.variant.Lineage, cl.variant.Umi
+				for _, e := range cl.variant.Errors {
+					if e.Pos < p-cl.start {
+						v.Errors = append(v.Errors, e)
+					}
+				}
+			}
+			if b := tt.Var[idx]; b != nil {
+				v.EndSite = b.EndSite
+			}
+			return &pcrClone{start: cl.start, end: tt.End[idx], variant: v, count: 1}, true
+		}
+		// Continue on the new template before the homologous region:
+		if s == 0 {
+			continue
+		}
+		idx, ok := tt.sampleCovering(s-1, s+h, rand)
+		if !ok || (same && tt.Start[idx] >= cl.end) {
+			continue
+		}
+		start := tt.Start[idx]
+		j := &PcrJunction{X: s, Y: p}
+		if !same {
+			j.Partner, j.Head, j.Seq = nt.GetName(), true, nt.SubSeq(start, s)
+		}
+		v := &FragVariant{}
+		if !same || s != p {
+			v.Junction = j
+		}
+		if cl.variant != nil {
+			v.EndSite, v.Lineage, v.Umi = cl.variant.EndSite, cl.variant.Lineage, cl.variant.Umi
+			for _, e := range cl.variant.Errors {
+				if e.Pos >= p-cl.start {
+					e.Pos = (s - start) + (e.Pos - (p - cl.start))
+					v.Errors = append(v.Errors, e)
+				}
+			}
+		}
+		if b := tt.Var[idx]; b != nil {
+			v.StartSite = b.StartSite
+		}
+		return &pcrClone{start: start, end: cl.end, variant: v, count: 1}, true
+	}
+	return nil, false
+}
+
+// Distance between the breakpoint positions of a chimera within a transcript:
+func (j PcrJunction) Shift() uint32 {
+	if j.X > j.Y {
+		return j.X - j.Y
+	}
+	return j.Y - j.X
+}
+
+// The coordinates of the part copied from a partner transcript are prefixed by its name:
+func (j PcrJunction) String() string {
+	switch {
+	case j.Partner == "":
+		return fmt.Sprintf("%d-%d", j.X, j.Y)
+	case j.Head:
+		return fmt.Sprintf("%s:%d-%d", j.Partner, j.X, j.Y)
+	}
+	return fmt.Sprintf("%d-%s:%d", j.X, j.Partner, j.Y)
+}
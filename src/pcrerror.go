@@ -0,0 +1,273 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Sequence edit introduced by the polymerase. Positions are relative to
+// the start of the fragment on the plus strand:
+type SeqEdit struct {
+	Pos uint32
+	Op  byte // 'S': substitution, 'I': insertion before Pos, 'D': deletion.
+	Ref byte
+	Alt byte
+}
+
+// Format an edit at the given transcript coordinate:
+func (e SeqEdit) Format(pos uint32) string {
+	switch e.Op {
+	case 'I':
+		return fmt.Sprintf("%d:+%c", pos, e.Alt)
+	case 'D':
+		return fmt.Sprintf("%d:-%c", pos, e.Ref)
+	}
+	return fmt.Sprintf("%d:%c>%c", pos, e.Ref, e.Alt)
+}
+
+// Format the edits of a fragment variant using transcript coordinates,
+// edits in the second part of PCR chimeras are marked by an asterisk:
+func FormatEdits(v *FragVariant, start uint32) string {
+	s := make([]string, len(v.Errors))
+	for i, e := range v.Errors {
+		pos, second := v.TrCoord(start, e.Pos)
+		s[i] = e.Format(pos)
+		if second {
+			s[i] = "*" + s[i]
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// Apply edits to the plus strand sequence of a fragment:
+func ApplyEdits(seq string, edits []SeqEdit) string {
+	if len(edits) == 0 {
+		return seq
+	}
+	sorted := make([]SeqEdit, len(edits))
+	copy(sorted, edits)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Pos < sorted[j].Pos })
+
+	b := make([]byte, 0, len(seq)+len(edits))
+	j := 0
+	for i := 0; i <= len(seq); i++ {
+		base := byte(0)
+		if i < len(seq) {
+			base = seq[i]
+		}
+		for ; j < len(sorted) && int(sorted[j].Pos) == i; j++ {
+			switch sorted[j].Op {
+			case 'I':
+				b = append(b, sorted[j].Alt)
+			case 'D':
+				base = 0
+			case 'S':
+				if base != 0 {
+					base = sorted[j].Alt
+				}
+			}
+		}
+		if base != 0 {
+			b = append(b, base)
+		}
+	}
+	return string(b)
+}
+
+// Polymerase errors per base and duplication:
+type PcrErrorModel struct {
+	SubRate   float64
+	IndelRate float64
+}
+
+func NewPcrErrorModel(subRate float64, indelRate float64) *PcrErrorModel {
+	if subRate < 0.0 || indelRate < 0.0 || subRate+indelRate >= 1.0 {
+		L.Fatalf("Invalid PCR error rates: %g, %g", subRate, indelRate)
+	}
+	m := &PcrErrorModel{subRate, indelRate}
+	if m.Active() {
+		L.PrintfV("PCR substitution rate: %g, indel rate: %g", subRate, indelRate)
+	}
+	return m
+}
+
+func (m PcrErrorModel) Active() bool {
+	return m.SubRate > 0.0 || m.IndelRate > 0.0
+}
+
+// Probability that a copy of a fragment carries at least one new error:
+func (m PcrErrorModel) ErrorProb(length uint32) float64 {
+	return 1.0 - math.Pow(1.0-m.SubRate-m.IndelRate, float64(length))
+}
+
+// Sample the errors of a copy known to carry at least one new error,
+// the errors of the template are inherited:
+func (m PcrErrorModel) SampleEdits(seq string, inherited []SeqEdit, rand Rander) []SeqEdit {
+	length := uint64(len(seq))
+	nr := 1 + rand.Binomial(length-1, m.SubRate+m.IndelRate)
+	edits := make([]SeqEdit, len(inherited), len(inherited)+int(nr))
+	copy(edits, inherited)
+	for i := uint64(0); i < nr; i++ {
+		pos := uint32(rand.Int63n(int64(length)))
+		e := SeqEdit{Pos: pos, Ref: seq[pos]}
+		u := rand.Float64() * (m.SubRate + m.IndelRate)
+		switch {
+		case u < m.SubRate:
+			e.Op = 'S'
+			e.Alt = packedBases[rand.Int63n(4)]
+			for e.Alt == e.Ref {
+				e.Alt = packedBases[rand.Int63n(4)]
+			}
+		case u < m.SubRate+m.IndelRate/2.0:
+			e.Op = 'I'
+			e.Alt = packedBases[rand.Int63n(4)]
+		default:
+			e.Op = 'D'
+		}
+		edits = append(edits, e)
+	}
+	return edits
+}
+
+// Copies carrying new errors made in the same cycle from templates of the same kind.
+// Every copy founds a lineage, and the errors of a lineage are only sampled when it
+// is first drawn, so all drawn molecules of a lineage share its errors. The molecules
+// of the copies are split evenly between the lineages. The template and the errors of
+// a lineage are drawn from a random stream derived from the seed and the lineage, so
+// they do not depend on when the lineage is drawn (e.g. after loading a checkpoint):
+type PcrPending struct {
+	Parents  []uint32 // Variant indices of the templates.
+	Founders []uint64 // Cumulative number of lineages founded by the templates.
+	Seed     int64
+	Errors   *PcrErrorModel
+	Lineages map[uint64]*PcrLineage // Lineages drawn so far.
+	NrTaken  uint64
+}
+
+type PcrLineage struct {
+	Variant *FragVariant
+	Taken   uint64 // Molecules removed by sampling.
+}
+
+// Record the lineages founded by copying a template:
+func (p *PcrPending) Add(parent uint32, n uint64) {
+	var total uint64
+	if k := len(p.Founders); k > 0 {
+		total = p.Founders[k-1]
+		if p.Parents[k-1] == parent {
+			p.Founders[k-1] += n
+			return
+		}
+	}
+	p.Parents = append(p.Parents, parent)
+	p.Founders = append(p.Founders, total+n)
+}
+
+// Variant of a molecule drawn from a fragment entry holding count molecules, resolving
+// pending lineages. The molecule is removed from its lineage if take is true:
+func (tr Transcript) DrawVariant(i uint32, start uint32, end uint32, count uint64, take bool, rand Rander) *FragVariant {
+	v := tr.GetVariant(i)
+	if v == nil || v.Pending == nil {
+		return v
+	}
+	tr.varLock.Lock()
+	defer tr.varLock.Unlock()
+	p := v.Pending
+	return tr.drawLineage(p, start, end, count+p.NrTaken, take, rand)
+}
+
+// Draw a lineage, proportionally to its remaining molecules if the molecule is taken,
+// and sample its errors on top of those of its template if not done yet:
+func (tr Transcript) drawLineage(p *PcrPending, start uint32, end uint32, total uint64, take bool, rand Rander) *FragVariant {
+	n := p.Founders[len(p.Founders)-1]
+	if total < n {
+		total = n
+	}
+	var k uint64
+	for {
+		k = uint64(rand.Int63n(int64(n)))
+		if !take {
+			break
+		}
+		size := total / n
+		if k < total%n {
+			size++
+		}
+		var taken uint64
+		if l, ok := p.Lineages[k]; ok {
+			taken = l.Taken
+		}
+		if rand.Float64()*float64(size) < float64(size-taken) {
+			break
+		}
+	}
+	if p.Lineages == nil {
+		p.Lineages = make(map[uint64]*PcrLineage)
+	}
+	l, ok := p.Lineages[k]
+	if !ok {
+		lrand := NewStreamRand(StreamSeed(p.Seed, k))
+		// The template of the founder is drawn without removing it:
+		j := sort.Search(len(p.Founders), func(j int) bool { return p.Founders[j] > k })
+		parent := tr.GetVariant(p.Parents[j])
+		if parent != nil && parent.Pending != nil {
+			parent = tr.drawLineage(parent.Pending, start, end, 0, false, lrand)
+		}
+		seq := parent.Template(tr, start, end)
+		if parent != nil {
+			seq = parent.WithErrors(nil).Apply(seq)
+		}
+		l = &PcrLineage{Variant: p.Errors.Faulty(parent, seq, lrand)}
+		p.Lineages[k] = l
+	}
+	if take {
+		l.Taken++
+		p.NrTaken++
+	}
+	return l.Variant
+}
+
+// Variant of a copy carrying new errors, which can also hit the UMI:
+func (m PcrErrorModel) Faulty(v *FragVariant, seq string, rand Rander) *FragVariant {
+	var inherited []SeqEdit
+	if v != nil {
+		inherited = v.Errors
+	}
+	if v.UmiLen() == 0 {
+		return v.WithErrors(m.SampleEdits(seq, inherited, rand))
+	}
+	umi, edits := m.SampleTagged(v.Umi.Seq, seq, inherited, rand)
+	nv := v.WithErrors(edits)
+	nv.Umi = &UmiTag{Seq: umi, Orig: v.Umi.Orig, Mol: v.Umi.Mol}
+	return nv
+}
@@ -0,0 +1,261 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Amplification state of a transcript kept between cycles:
+type pcrState struct {
+	effs      map[uint32][]float64 // Base efficiencies of fragments by length.
+	gcBins    map[uint32][]uint32  // GC bins of fragments by length.
+	templates *trTemplates         // Pre-PCR fragments serving as templates for PCR chimeras.
+	traj      *PcrTrajectory
+	cycle     int64
+}
+
+// Efficiency multiplier in a cycle: the primers and dNTPs are shared by
+// the whole pool and the reaction saturates as the total product approaches the capacity:
+func (tn Techne) PlateauMul(total uint64) float64 {
+	if tn.Capacity <= 0.0 {
+		return 1.0
+	}
+	m := 1.0 - float64(total)/tn.Capacity
+	if m < 0.0 {
+		return 0.0
+	}
+	return m
+}
+
+// The whole pool is amplified together when the reaction saturates, or when PCR
+// chimeras can switch to the templates of other transcripts:
+func (tn Techne) PoolWide() bool {
+	return tn.Capacity > 0.0 || tn.Chimeras.Active()
+}
+
+// Amplify the fragments of all transcripts together, cycle by cycle:
+func (tn Techne) PcrPool(transcripts []Transcripter, p Pooler, st FragStater, workers int, seed int64) {
+	trs := make([]Transcripter, len(transcripts))
+	copy(trs, transcripts)
+	sort.Slice(trs, func(i, j int) bool { return trs[i].GetId() < trs[j].GetId() })
+
+	// The fragments stay loaded between the cycles, as the state of every fragment
+	// is kept in memory anyway:
+	states := make([]*pcrState, len(trs))
+	counts := make([]uint64, len(trs))
+	tn.forEachTranscript(trs, workers, func(i int, tr Transcripter, rand Rander) {
+		states[i], counts[i] = tn.newPcrState(tr, st)
+	}, seed, true, false)
+	total := sumUint64(counts)
+
+	// New templates of PCR chimeras can come from any transcript of the pool:
+	var templates *pcrTemplates
+	if tn.Chimeras.Active() {
+		frags := make([]*trTemplates, len(trs))
+		for i, s := range states {
+			frags[i] = s.templates
+		}
+		templates = newPcrTemplates(trs, frags, tn.Chimeras.MinOverlap)
+	}
+
+	for c := int64(0); c < tn.NrCycles; c++ {
+		mul := tn.PlateauMul(total)
+		L.PrintfV("PCR cycle %d: %d molecules, efficiency multiplier: %g\n", c+1, total, mul)
+		tn.forEachTranscript(trs, workers, func(i int, tr Transcripter, rand Rander) {
+			rand.Reseed(StreamSeed(StreamSeed(seed, tr.GetId()), uint64(c)))
+			counts[i] = tn.Cycle(tr, states[i], templates, mul, st, rand)
+		}, seed, false, false)
+		total = sumUint64(counts)
+	}
+	L.PrintfV("Molecules after PCR: %d\n", total)
+	for _, s := range states {
+		st.UpdatePcrTrajectory(s.traj)
+	}
+
+	// Register the amplified fragments:
+	tn.forEachTranscript(trs, workers, func(i int, tr Transcripter, rand Rander) {
+		for length, sec := range *tr.GetFragStructs() {
+			var count uint64
+			for _, n := range sec.Count {
+				count += n
+			}
+			p.RegisterFragments(tr, length, count)
+			st.UpdateAfterPcr(length, count)
+		}
+	}, seed, false, true)
+}
+
+// Apply a function to every transcript using a pool of workers, the fragments are
+// loaded from the cache before and stored to the cache after the call if requested:
+func (tn Techne) forEachTranscript(trs []Transcripter, workers int, f func(int, Transcripter, Rander), seed int64, load bool, store bool) {
+	if workers < 1 {
+		workers = 1
+	}
+	next := make(chan int, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rand := NewRandGen(seed)
+			for i := range next {
+				if load {
+					trs[i].Ungob()
+				}
+				f(i, trs[i], rand)
+				if store {
+					trs[i].Gob()
+				}
+			}
+		}()
+	}
+	for i := range trs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+func sumUint64(s []uint64) (sum uint64) {
+	for _, x := range s {
+		sum += x
+	}
+	return
+}
+
+// Calculate the base efficiencies of the fragments of a transcript:
+func (tn Techne) newPcrState(tr Transcripter, st FragStater) (*pcrState, uint64) {
+	s := &pcrState{effs: make(map[uint32][]float64), gcBins: make(map[uint32][]uint32), traj: NewPcrTrajectory()}
+	if tn.Chimeras.Active() {
+		s.templates = newTrTemplates(tr)
+	}
+	var total uint64
+	for length, sec := range *tr.GetFragStructs() {
+		var lengthEff float64
+		if tn.FixedEff == 0.0 {
+			lengthEff = tn.CalcLengthEff(length)
+		}
+		effs := make([]float64, len(sec.Count))
+		gcBins := make([]uint32, len(sec.Count))
+		for i := range sec.Count {
+			effs[i] = tn.fragEff(tr, sec.Start[i], sec.End[i], sec.Count[i], lengthEff, st)
+			total += sec.Count[i]
+			gcBin, lenBin := tn.trajBins(tr.GcContent(sec.Start[i], sec.End[i]), length)
+			gcBins[i] = gcBin
+			s.traj.AddCount(gcBin, lenBin, tn.NrCycles, 0, sec.Count[i])
+		}
+		s.effs[length] = effs
+		s.gcBins[length] = gcBins
+	}
+	tr.JettisonGcCache()
+	return s, total
+}
+
+// Simulate a single cycle with the efficiencies scaled by mul, returns the
+// number of molecules of the transcript:
+func (tn Techne) Cycle(tr Transcripter, s *pcrState, templates *pcrTemplates, mul float64, st FragStater, rand Rander) uint64 {
+	frags := tr.GetFragStructs()
+	lengths := make([]int, 0, len(*frags))
+	for length := range *frags {
+		lengths = append(lengths, int(length))
+	}
+	sort.Ints(lengths)
+
+	// New clones are added after the cycle:
+	clones := make([]*pcrClone, 0)
+	pending := make(map[pendingKey]*pcrClone)
+	var total uint64
+	s.cycle++
+	for _, l := range lengths {
+		length := uint32(l)
+		sec := (*frags)[length]
+		effs := s.effs[length]
+		for i := range sec.Count {
+			count := sec.Count[i]
+			copies := tn.DrawCopies(count, effs[i]*mul, rand)
+			if count+copies < count {
+				L.Fatal("Integer overflow detected when amplifying fragments!")
+			}
+			var faulty, switched uint64
+			v := tr.GetVariant(sec.Var[i])
+			if tn.Errors.Active() {
+				faulty = rand.Binomial(copies, tn.Errors.ErrorProb(length+v.UmiLen()))
+			}
+			// Chimeric products do not switch templates again:
+			if tn.Chimeras.Active() && (v == nil || v.Junction == nil) {
+				switched = rand.Binomial(copies-faulty, tn.Chimeras.Rate)
+			}
+			sec.Count[i] += copies - faulty - switched
+			if faulty+switched == 0 {
+				continue
+			}
+
+			cl := &pcrClone{start: sec.Start[i], end: sec.End[i], variant: v, idx: sec.Var[i]}
+			tn.initClone(tr, cl, 0.0, nil)
+			if faulty > 0 {
+				if pc := tn.addFaulty(tr, pending, cl, faulty, rand); pc != nil {
+					clones = append(clones, pc)
+				}
+			}
+			for k := uint64(0); k < switched; k++ {
+				nc, ok := tn.switchClone(tr, templates, cl, st, rand)
+				if !ok {
+					// The product was completed on its original template:
+					sec.Count[i]++
+					continue
+				}
+				clones = append(clones, nc)
+			}
+		}
+		_, lenBin := tn.trajBins(0.0, length)
+		for i, n := range sec.Count {
+			total += n
+			s.traj.AddCount(s.gcBins[length][i], lenBin, tn.NrCycles, s.cycle, n)
+		}
+	}
+
+	// Store the new clones:
+	for _, cl := range clones {
+		length := uint32(len(cl.seq))
+		sec := (*frags)[length]
+		sec.Start = append(sec.Start, cl.start)
+		sec.End = append(sec.End, cl.end)
+		sec.Var = append(sec.Var, cl.idx)
+		sec.Count = append(sec.Count, cl.count)
+		(*frags)[length] = sec
+		s.effs[length] = append(s.effs[length], cl.eff)
+		gcBin, lenBin := tn.trajBins(SeqGcContent(cl.seq), length)
+		s.gcBins[length] = append(s.gcBins[length], gcBin)
+		s.traj.AddCount(gcBin, lenBin, tn.NrCycles, s.cycle, cl.count)
+		total += cl.count
+	}
+	return total
+}
@@ -31,10 +31,13 @@ package main
 import (
 	"os"
 	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 type Pooler interface {
-	InitTranscripts(input Inputer, tg Targeter, fg Fragmentor, tc Thermocycler, st FragStater, GCFreq int, polyAParam *TargetMix, exprMul float64, rand Rander, pcrRand Rander)
+	InitTranscripts(input Inputer, tg Targeter, fg Fragmentor, tc Thermocycler, st FragStater, GCFreq int, polyAParam *TargetMix, exprMul float64, workers int, rand Rander, pcrRand Rander)
 	AddTranscript(tr Transcripter)
 	GetGobDir() string
 	RegisterFragments(tr Transcripter, length uint32, count uint64)
@@ -45,6 +48,8 @@ type Pooler interface {
 	String() string
 	JettisonLenTrCounts(l uint32)
 	Cleanup()
+	SaveCheckpoint(file string, hash string, st FragStater)
+	LoadCheckpoint(file string, hash string) FragStater
 }
 
 type TrCountMap map[Transcripter]uint64
@@ -60,67 +65,115 @@ type Pool struct {
 	LenTrCountMap     LenTrCountMap
 	LenTrCountStructs map[uint32]*TrCountStruct
 	GobDir            string
+	Store             *FragStore
+	Lineage           bool
+	Capture           *PolyACapture
+	Umis              *UmiModel
+	lock              *sync.Mutex
 }
 
 // Pool constructor:
-func NewPool(gobDir string) *Pool {
+func NewPool(gobDir string, mmap bool, maxMem int64, lineage bool, capture *PolyACapture, umis *UmiModel) *Pool {
 	p := new(Pool)
 	tmp := make([]Transcripter, 0)
 	p.Transcripts = &tmp
 	p.LenTrCountMap = make(LenTrCountMap)
 	p.LenTrCountStructs = make(map[uint32]*TrCountStruct)
 	p.GobDir = gobDir
+	p.Lineage = lineage
+	p.Capture = capture
+	p.Umis = umis
+	if lineage {
+		L.PrintfV("Tracking the source molecules of fragments.")
+	}
+	p.lock = new(sync.Mutex)
 	if p.GobDir != "" {
 		err := os.Mkdir(p.GobDir, 0700)
 		if err != nil {
 			L.Fatalf("Cannot create gob directory \"%s\": %s", p.GobDir, err.Error())
 		}
+		p.Store = NewFragStore(p.GobDir, mmap)
+		if maxMem > 0 {
+			p.Store.Budget = NewMemBudget(maxMem)
+		}
 	}
 	return p
 }
 
 // Initialize transcripts from input
-func (p Pool) InitTranscripts(input Inputer, tg Targeter, fg Fragmentor, tc Thermocycler, st FragStater, GCFreq int, polyAParam *TargetMix, exprMul float64, rand Rander, pcrRand Rander) {
+func (p Pool) InitTranscripts(input Inputer, tg Targeter, fg Fragmentor, tc Thermocycler, st FragStater, GCFreq int, polyAParam *TargetMix, exprMul float64, workers int, rand Rander, pcrRand Rander) {
 	_, polyAmax := getGlobalMinMax(polyAParam)
 	L.PrintfV("Poly(A) tail distribution components:")
 	for _, l := range StringToSlice(polyAParam.String()) {
 		L.PrintfV("%s\n", l)
 	}
-	c := input.GetTranscriptChan(p.GobDir, int(polyAmax), st, exprMul)
+	c := input.GetTranscriptChan(p.Store, int(polyAmax), st, exprMul)
 
 	if p.GobDir != "" {
-		L.PrintfV("Fragments will be cached to %s.", p.GobDir)
+		L.PrintfV("Fragments will be cached to %s.", p.Store.Path)
 	}
 
-	L.PrintfV("Fragmenting transcripts and amplifying fragments:\n")
+	L.PrintfV("Fragmenting transcripts and amplifying fragments using %d workers:\n", workers)
 	var trCount uint64
 
+	// Every transcript gets its own random streams derived from these seeds,
+	// so the results do not depend on the scheduling of the workers:
+	fragSeed := rand.Int63()
+	pcrSeed := pcrRand.Int63()
+
 	// Collect garbage before starting fragmentation:
 	runtime.GC()
 
-	for tr := range c {
-		L.PrintfV("\t%d\t%s\n", trCount, tr.String())
-		// Skip if not expressed:
-		if tr.GetExprLevel() == 0 {
-			trCount++
-			continue
-		}
-		// Fragment transcript:
-		tr.Fragment(tg, fg, polyAParam, int(polyAmax), st, rand) // uses initial seed
-		// Flatten fragment table:
-		tr.Flatten()
-		// Amplify fragments:
-		tr.Pcr(p, tc, st, pcrRand) // uses initial or PCR seed
-		// Add transcript to pool:
-		p.AddTranscript(tr)
-		// Store fragments:
-		tr.Gob()
-		// Explicitly trigger GC:
-		if (GCFreq > 0) && ((int(trCount) % GCFreq) == 0) {
-			runtime.GC()
-		}
-		// Increase transcript counter:
-		trCount++
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wRand := NewRandGen(fragSeed)
+			wPcrRand := NewRandGen(pcrSeed)
+			for tr := range c {
+				count := atomic.AddUint64(&trCount, 1) - 1
+				L.PrintfV("\t%d\t%s\n", count, tr.String())
+				// Skip if not expressed:
+				if tr.GetExprLevel() == 0 {
+					continue
+				}
+				if p.Lineage {
+					tr.EnableLineage()
+				}
+				// Fragment transcript:
+				wRand.Reseed(StreamSeed(fragSeed, tr.GetId()))
+				tr.Fragment(tg, fg, polyAParam, int(polyAmax), p.Capture, st, wRand) // uses initial seed
+				// Flatten fragment table:
+				tr.Flatten()
+				// Attach UMIs to the pre-PCR molecules:
+				if p.Umis.Active() {
+					tr.AttachUmis(p.Umis, wRand)
+				}
+				// Amplify fragments, unless the whole pool is amplified together:
+				if !tc.PoolWide() {
+					wPcrRand.Reseed(StreamSeed(pcrSeed, tr.GetId()))
+					tr.Pcr(p, tc, st, wPcrRand) // uses initial or PCR seed
+				}
+				// Add transcript to pool:
+				p.AddTranscript(tr)
+				// Store fragments:
+				tr.Gob()
+				// Explicitly trigger GC:
+				if (GCFreq > 0) && ((int(count) % GCFreq) == 0) {
+					runtime.GC()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Order the transcripts as in the input, independently of the workers:
+	trs := *p.Transcripts
+	sort.Slice(trs, func(i, j int) bool { return trs[i].GetId() < trs[j].GetId() })
+
+	if tc.PoolWide() {
+		tc.PcrPool(p.GetTranscripts(), p, st, workers, pcrSeed)
 	}
 
 	// Jettison primer cache:
@@ -148,12 +201,16 @@ func (p Pool) GetNrTranscripts() int {
 
 // Add a transcript to pool:
 func (p Pool) AddTranscript(tr Transcripter) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	tmp := p.Transcripts
 	*tmp = append(*p.Transcripts, tr)
 }
 
 // Register fragments into LenTrCountMap:
 func (p Pool) RegisterFragments(tr Transcripter, length uint32, count uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	trc, ok := p.LenTrCountMap[length]
 	// New length:
 	if !ok {
@@ -173,13 +230,15 @@ func (p Pool) Flatten() {
 	for length, trcm := range p.LenTrCountMap {
 		// Linearize transcript/count map into slices:
 		size := len(trcm)
-		trS := make([]Transcripter, size)
+		trS := make([]Transcripter, 0, size)
+		for tr := range trcm {
+			trS = append(trS, tr)
+		}
+		// Order by transcript id to make sampling reproducible:
+		sort.Slice(trS, func(i, j int) bool { return trS[i].GetId() < trS[j].GetId() })
 		countS := make([]uint64, size)
-		i := 0
-		for tr, count := range trcm {
-			trS[i] = tr
-			countS[i] = count
-			i++
+		for i, tr := range trS {
+			countS[i] = trcm[tr]
 		}
 		m[length] = &TrCountStruct{trS, countS}
 		// Delete transcript/count map:
@@ -214,6 +273,7 @@ func (p Pool) Cleanup() {
 	for _, tr := range *p.Transcripts {
 		tr.Cleanup()
 	}
+	p.Store.Remove()
 	err := os.RemoveAll(p.GobDir)
 	if err != nil {
 		L.Fatalf("Could not remove gob directory \"%s\": %s", p.GobDir, err.Error())
@@ -0,0 +1,110 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Relative concentrations of the primers in the primer pool. Primers are
+// stored in 5'->3' orientation. Primers missing from the table are absent.
+type PrimerPool struct {
+	Name string
+	Conc map[string]float64
+}
+
+// Load a primer concentration table or a list of primers.
+// Every line contains a primer sequence optionally followed by its relative
+// concentration (1.0 if omitted). Lines starting with '#' are ignored.
+func LoadPrimerPool(file string, kmerLength uint32) *PrimerPool {
+	f, err := os.Open(file)
+	if err != nil {
+		L.Fatalf("Could not open primer file \"%s\": %s", file, err.Error())
+	}
+	defer f.Close()
+	pp := &PrimerPool{Name: file, Conc: make(map[string]float64)}
+
+	scanner := bufio.NewScanner(f)
+	lineNr := 0
+	for scanner.Scan() {
+		lineNr++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			L.Fatalf("Malformed line %d in primer file \"%s\": %s", lineNr, file, line)
+		}
+		primer := strings.ToUpper(fields[0])
+		if uint32(len(primer)) != kmerLength || strings.Trim(primer, "ACGT") != "" {
+			L.Fatalf("Invalid primer \"%s\" at line %d in primer file \"%s\"!", fields[0], lineNr, file)
+		}
+		conc := 1.0
+		if len(fields) == 2 {
+			n, err := fmt.Sscanf(fields[1], "%g", &conc)
+			if n != 1 || err != nil || conc < 0 {
+				L.Fatalf("Invalid concentration at line %d in primer file \"%s\": %s", lineNr, file, line)
+			}
+		}
+		pp.Conc[primer] += conc
+	}
+	if err := scanner.Err(); err != nil {
+		L.Fatalf("Error when reading primer file \"%s\": %s", file, err.Error())
+	}
+	if len(pp.Conc) == 0 {
+		L.Fatalf("No primers found in primer file \"%s\"!", file)
+	}
+	pp.normalize(kmerLength)
+	return pp
+}
+
+// Scale concentrations to average to 1.0 over all possible primers, so the
+// affinities are comparable to those of a uniform primer pool.
+func (pp PrimerPool) normalize(kmerLength uint32) {
+	var total float64
+	for _, c := range pp.Conc {
+		total += c
+	}
+	if total <= 0 {
+		L.Fatalf("The total primer concentration in \"%s\" must be positive!", pp.Name)
+	}
+	scaler := float64(uint64(1)<<(2*kmerLength)) / total
+	for p, c := range pp.Conc {
+		pp.Conc[p] = c * scaler
+	}
+}
+
+// Concentration of the primer binding to the given site (matching the template in its orientation):
+func (pp PrimerPool) SiteConc(site string) float64 {
+	return pp.Conc[RevCompDNA(site)]
+}
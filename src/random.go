@@ -38,6 +38,7 @@ import (
 
 type Rander interface {
 	Split() Rander
+	Reseed(seed int64)
 	Int63() int64
 	Int63n(n int64) int64
 	Int31n(n int32) int32
@@ -76,11 +77,36 @@ func NewRandGen(seed int64) (rg *RandGen) {
 	return
 }
 
+// Generator allocating its sampler buffers on demand, used for short random streams:
+func NewStreamRand(seed int64) (rg *RandGen) {
+	rg = new(RandGen)
+	rg.Seed = seed
+	rg.source = rand.NewSource(seed)
+	rg.rand = rand.New(rg.source)
+	rg.Suint64 = new([]uint64)
+	rg.Sfloat64 = new([]float64)
+	return
+}
+
 func (rg RandGen) Split() Rander {
 	seed := rg.Int63()
 	return NewRandGen(seed)
 }
 
+// Reset the state of the generator:
+func (rg RandGen) Reseed(seed int64) {
+	rg.rand.Seed(seed)
+}
+
+// Derive the seed of a random stream assigned to an object from a base seed:
+func StreamSeed(base int64, id uint64) int64 {
+	// SplitMix64 finalizer:
+	z := uint64(base) + (id+1)*0x9E3779B97F4A7C15
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return int64((z ^ (z >> 31)) >> 1)
+}
+
 func (rg RandGen) Int63() int64 {
 	return rg.rand.Int63()
 }
@@ -181,7 +207,7 @@ func (rg RandGen) Binomial(n uint64, pp float64) uint64 {
 	if n < 25 {
 
 		for j = 1; j <= n; j++ {
-			if rand.Float64() < p {
+			if rg.rand.Float64() < p {
 				bnl++
 			}
 		}
@@ -202,7 +228,7 @@ func (rg RandGen) Binomial(n uint64, pp float64) uint64 {
 		for {
 		LOR:
 			for {
-				angle := math.Pi * rand.Float64()
+				angle := math.Pi * rg.rand.Float64()
 				y = math.Tan(angle)
 				em = sq*y + am
 				// Loop control:
@@ -217,7 +243,7 @@ func (rg RandGen) Binomial(n uint64, pp float64) uint64 {
 			t = 1.2 * sq * (1.0 + y*y) * math.Exp(g-Lgamma(em+1.0)-Lgamma(en-em+1.0)+em*plog+(en-em)*pclog)
 
 			// Reject:
-			if rand.Float64() > t {
+			if rg.rand.Float64() > t {
 			} else {
 				break REJ
 			}
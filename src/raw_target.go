@@ -30,6 +30,7 @@ package main
 
 import (
 	"math"
+	"sort"
 )
 
 type RawTarget struct {
@@ -126,6 +127,8 @@ func (tg RawTarget) SampleLengths(rand Rander) {
 		delete(tmp, length)
 		i++
 	}
+	// Order by length, so the transcripts are sampled reproducibly:
+	sort.Sort(lcs)
 }
 
 func (tg RawTarget) NextLenCount() (length uint32, count uint64, ok bool) {
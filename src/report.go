@@ -40,6 +40,8 @@ type Reporter interface {
 	ReportSliceInt32t64(x []uint32, y []uint64, xl string, yl string, title string, vis string)
 	ReportSliceInt32f64(x []uint32, y []float64, xl string, yl string, title string, vis string)
 	ReportSliceFloat64f64(x []float64, y []float64, xl string, yl string, title string, vis string)
+	ReportMapStringf64(m map[string]float64, xl string, yl string, title string, vis string)
+	ReportMatrix(x []float64, y []uint32, z [][]float64, xl string, yl string, title string, vis string)
 	WriteJSON()
 }
 
@@ -137,6 +139,32 @@ func (r Report) ReportSliceFloat64f64(x []float64, y []float64, xl string, yl st
 	r.IncPos()
 }
 
+func (r Report) ReportMapStringf64(m map[string]float64, xl string, yl string, title string, vis string) {
+	data := make(map[string]float64, len(m))
+	for x, y := range m {
+		data[x] = y
+	}
+	cont := JSONEntry{Xl: xl, Yl: yl, Data: data, Vis: vis, Pos: *r.cursor}
+	r.JSONPool[title] = cont
+	r.IncPos()
+}
+
+// Matrix data: z holds a row for every y value.
+type JSONMatrix struct {
+	X []float64
+	Y []uint32
+	Z [][]float64
+}
+
+func (r Report) ReportMatrix(x []float64, y []uint32, z [][]float64, xl string, yl string, title string, vis string) {
+	if len(z) != len(y) {
+		L.Fatalf("Cannot report %s: y/z length mismatch!\n", title)
+	}
+	cont := JSONEntry{Xl: xl, Yl: yl, Data: JSONMatrix{x, y, z}, Vis: vis, Pos: *r.cursor}
+	r.JSONPool[title] = cont
+	r.IncPos()
+}
+
 func (r Report) WriteJSON() {
 	bytes, err := json.Marshal(r.JSONPool)
 	if err != nil {
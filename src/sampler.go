@@ -31,6 +31,7 @@ package main
 import (
 	"fmt"
 	"runtime"
+	"sort"
 )
 
 type LenCountMap map[uint32]uint64
@@ -42,7 +43,10 @@ type Sampler interface {
 }
 
 type LenSampler struct {
-	StrandBias float64
+	LibType    *LibType
+	Chimerizer *Chimerizer
+	Library    *LibraryBuilder
+	Umis       *UmiModel
 }
 
 type Request struct {
@@ -56,9 +60,12 @@ func NewRequest(tr Transcripter, length uint32, count uint64) *Request {
 	return req
 }
 
-func NewLenSampler(StrandBias float64) (sl *LenSampler) {
+func NewLenSampler(libType *LibType, chimerizer *Chimerizer, library *LibraryBuilder, umis *UmiModel) (sl *LenSampler) {
 	sl = new(LenSampler)
-	sl.StrandBias = StrandBias
+	sl.LibType = libType
+	sl.Chimerizer = chimerizer
+	sl.Library = library
+	sl.Umis = umis
 	return
 }
 
@@ -120,46 +127,67 @@ func (sl LenSampler) SampleFragments(p Pooler, tg Targeter, st FragStater, rand
 		randS[i] = rand.Split()
 	}
 
-	// Iterate over transcripts:
+	// Iterate over transcripts in the order of their ids, so the output is reproducible:
+	trs := make([]Transcripter, 0, len(trLenCount))
+	for tr := range trLenCount {
+		trs = append(trs, tr)
+	}
+	sort.Slice(trs, func(i, j int) bool { return trs[i].GetId() < trs[j].GetId() })
+
 	var fragCount uint64
-	for tr, LenCount := range trLenCount {
+	for _, tr := range trs {
 		// Ungob fragments:
 		tr.Ungob()
 
-		// Make request channel:
-		reqChan := make(chan *Request, 500)
-		// Make fragment chanel slice:
+		// Make request and fragment chanel slices:
+		reqChans := make([](chan *Request), procs)
 		fragChans := make([](chan Fragment), procs)
 
 		// Launch length sampler gorutines:
 		for i := 0; i < procs; i++ {
-			fragChans[i] = sl.GetFragChan(reqChan, randS[i])
+			reqChans[i] = make(chan *Request, 500)
+			fragChans[i] = sl.GetFragChan(reqChans[i], randS[i])
 		}
 
 		// Send requests:
-		go sl.FillReqChan(reqChan, tr, LenCount)
+		go sl.FillReqChans(reqChans, tr, trLenCount[tr])
 
 		// Receive and count fragments:
-		fragCount += sl.ReceiveFragments(fragChans)
+		fragCount += sl.ReceiveFragments(fragChans, st, rand)
 
 		// Jettison fragment structures:
 		tr.JettisonFragStructs()
 
 	}
 
+	// Output fragments left without a chimera partner:
+	for _, f := range sl.Chimerizer.Flush(st, rand) {
+		sl.EmitFragment(f, fragCount, st, rand)
+		fragCount++
+	}
+
 	st.LogSamplingRatio(fragCount)
 	st.UpdateNrSampled(fragCount)
 	L.PrintfV("Sampled %d fragments.\n", fragCount)
 	L.PrintfV("Missing fragments: %d\n", uint64(tg.GetReqFrags())-fragCount)
 }
 
-func (sl LenSampler) FillReqChan(reqChan chan *Request, tr Transcripter, LenCount LenCountMap) {
+// Distribute the requests over the samplers in the order of lengths, so every sampler
+// gets the same requests in every run:
+func (sl LenSampler) FillReqChans(reqChans [](chan *Request), tr Transcripter, LenCount LenCountMap) {
+	lengths := make([]int, 0, len(LenCount))
+	for l := range LenCount {
+		lengths = append(lengths, int(l))
+	}
+	sort.Ints(lengths)
 
-	for l, count := range LenCount {
-		reqChan <- NewRequest(tr, l, count)
+	for i, l := range lengths {
+		reqChans[i%len(reqChans)] <- NewRequest(tr, uint32(l), LenCount[uint32(l)])
 	}
 
-	close(reqChan)
+	for _, reqChan := range reqChans {
+		close(reqChan)
+	}
 	return
 }
 
@@ -184,7 +212,7 @@ func (sl LenSampler) GetFragChan(reqChan chan *Request, rand Rander) (c chan Fra
 	return
 }
 
-func (sl LenSampler) ReceiveFragments(fragChans [](chan Fragment)) uint64 {
+func (sl LenSampler) ReceiveFragments(fragChans [](chan Fragment), st FragStater, rand Rander) uint64 {
 	nrChans := len(fragChans)
 	var fragCount uint64
 EVER:
@@ -200,11 +228,11 @@ EVER:
 				closedChans++
 				continue CHANS
 			}
-			// Set fragment id:
-			frag = frag.SetId(fragCount)
-			// Print out fragment:
-			fmt.Printf("%s\n", frag.String())
-			fragCount++
+			// Simulate chimeras:
+			for _, f := range sl.Chimerizer.Process(frag, rand) {
+				sl.EmitFragment(f, fragCount, st, rand)
+				fragCount++
+			}
 
 		} // CHANS
 		// Break outer loop if all channels are closed:
@@ -216,12 +244,38 @@ EVER:
 	return fragCount
 }
 
+// Print out a sampled fragment and update statistics:
+func (sl LenSampler) EmitFragment(frag Fragment, id uint64, st FragStater, rand Rander) {
+	// Simulate adapter dimers and short inserts, add adapters:
+	frag = sl.Library.Build(frag, st, rand)
+	// Set fragment id:
+	frag = frag.SetId(id)
+	// Read the UMI:
+	if sl.Umis.Active() {
+		frag = sl.Umis.Label(frag, rand)
+	}
+	// Record primer mismatches at the read start:
+	st.UpdateReadStartMismatches(frag.GetReadStartMismatches())
+	// Record the pre-PCR fragment:
+	st.UpdateLineage(frag.GetTranscript(), frag.GetLineage())
+	// Record the errors introduced during PCR:
+	st.UpdatePcrErrors(uint32(len(frag.GetPcrErrors())))
+	// Record the origin of the fragment:
+	st.UpdateSampledOrigin(frag.GetOrigin())
+	// Print out fragment:
+	fmt.Printf("%s\n", frag.String())
+}
+
 func (sl LenSampler) SampleFragStrand(f Fragment, rand Rander) Fragment {
-	u := rand.Float64()
-	if u < sl.StrandBias {
-		f = f.SetStrand("-")
-	} else {
-		f = f.SetStrand("+")
+	origin := f.GetRNAStrand()
+	// Genomic DNA molecules originate from either strand:
+	if f.GetOrigin() == OriginGDNA && rand.Float64() < 0.5 {
+		origin = "-"
+	}
+	f = f.SetStrand(sl.LibType.SampleReadStrand(origin, rand))
+	// Record the strand of origin if the library type was set explicitly:
+	if sl.LibType.IsNamed() {
+		f = f.SetRNAStrand(origin)
 	}
 	return f
 }
@@ -0,0 +1,228 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+// Efficiency penalties for fragments with stable secondary structures or long homopolymers:
+type SeqFeatureModel struct {
+	FoldMode    string  // Fold the "ends" or the "whole" fragment, empty to ignore secondary structures.
+	FoldWindow  int     // Length of the folded fragment ends.
+	FoldScale   float64 // Free energy (kcal/mol) reducing the efficiency by a factor of e.
+	HomoMin     int     // Shortest penalized homopolymer run.
+	HomoPenalty float64 // Efficiency loss per base of penalized homopolymer runs.
+	stacks      map[string]float64
+	out         *bufio.Writer
+	file        *os.File
+	lock        *sync.Mutex
+}
+
+// Shortest and longest hairpin loops considered:
+const minHairpinLoop = 3
+const maxHairpinLoop = 30
+
+// Hairpin loop initiation free energies at 37C from SantaLucia and Hicks(2004):
+var hairpinLoopDG = [...]float64{0, 0, 0, 3.5, 3.5, 3.3, 4.0, 4.2, 4.3, 4.5}
+
+func NewSeqFeatureModel(foldMode string, foldWindow int, foldScale float64, homoMin int, homoPenalty float64, file string) *SeqFeatureModel {
+	m := new(SeqFeatureModel)
+	switch foldMode {
+	case "", "none":
+	case "ends", "whole":
+		m.FoldMode = foldMode
+	default:
+		L.Fatalf("Invalid folding mode: %s", foldMode)
+	}
+	if m.FoldMode == "ends" && foldWindow < minHairpinLoop+2 {
+		L.Fatalf("The folding window must be at least %d bases long!", minHairpinLoop+2)
+	}
+	if m.FoldMode != "" && foldScale <= 0.0 {
+		L.Fatalf("The hairpin free energy scale must be positive!")
+	}
+	if homoPenalty < 0.0 || homoPenalty > 1.0 {
+		L.Fatalf("The homopolymer penalty must be in the interval [0, 1]!")
+	}
+	if homoMin < 1 {
+		L.Fatalf("The minimum homopolymer length must be positive!")
+	}
+	m.FoldWindow = foldWindow
+	m.FoldScale = foldScale
+	m.HomoMin = homoMin
+	m.HomoPenalty = homoPenalty
+	if m.FoldMode != "" {
+		L.PrintfV("Hairpin penalty: folding %s (window: %d), free energy scale: %g kcal/mol", m.FoldMode, foldWindow, foldScale)
+		m.stacks = stackFreeEnergies(NNParamsSantaLucia2004(), 310.15)
+	}
+	if homoPenalty > 0.0 {
+		L.PrintfV("Homopolymer penalty: %g per base of runs longer than %d", homoPenalty, homoMin-1)
+	}
+
+	// Open file for per-fragment contributions:
+	if file != "" && m.Active() {
+		f, err := os.Create(file)
+		if err != nil {
+			L.Fatalf("Could not create sequence feature file \"%s\": %s", file, err.Error())
+		}
+		m.file = f
+		m.out = bufio.NewWriter(f)
+		m.lock = new(sync.Mutex)
+		fmt.Fprintf(m.out, "transcript\tstart\tend\tcount\tmfe\thomopolymer\tfactor\n")
+	}
+	return m
+}
+
+func (m *SeqFeatureModel) Active() bool {
+	return m != nil && (m.FoldMode != "" || m.HomoPenalty > 0.0)
+}
+
+// Free energies of the Watson-Crick stacks at temperature T (Kelvin):
+func stackFreeEnergies(p *NNParams, T float64) map[string]float64 {
+	dG := make(map[string]float64, len(p.DH))
+	for doublet, dH := range p.DH {
+		dG[doublet] = dH - T*p.DS[doublet]/1000.0
+	}
+	return dG
+}
+
+func hairpinLoopEnergy(size int) float64 {
+	last := len(hairpinLoopDG) - 1
+	if size <= last {
+		return hairpinLoopDG[size]
+	}
+	// Jacobson-Stockmayer extrapolation:
+	return hairpinLoopDG[last] + 1.75*0.61633*math.Log(float64(size)/float64(last))
+}
+
+func isPair(a byte, b byte) bool {
+	switch a {
+	case 'A':
+		return b == 'T'
+	case 'T':
+		return b == 'A'
+	case 'G':
+		return b == 'C'
+	case 'C':
+		return b == 'G'
+	}
+	return false
+}
+
+// Approximate the minimum free energy of a sequence by its most stable hairpin
+// with a perfect stem. Returns zero if no stable hairpin can form:
+func (m SeqFeatureModel) HairpinMfe(seq string) float64 {
+	var mfe float64
+	n := len(seq)
+	for i := 0; i < n; i++ {
+		for size := minHairpinLoop; size <= maxHairpinLoop; size++ {
+			j := i + size + 1
+			if j >= n {
+				break
+			}
+			if !isPair(seq[i], seq[j]) {
+				continue
+			}
+			// Extend the stem closing the loop:
+			e := hairpinLoopEnergy(size)
+			for k := 1; i-k >= 0 && j+k < n && isPair(seq[i-k], seq[j+k]); k++ {
+				e += m.stacks[seq[i-k:i-k+2]]
+			}
+			if e < mfe {
+				mfe = e
+			}
+		}
+	}
+	return mfe
+}
+
+// Free energy of the fragment ends or of the whole fragment:
+func (m SeqFeatureModel) Mfe(seq string) float64 {
+	if m.FoldMode == "whole" || len(seq) <= 2*m.FoldWindow {
+		return m.HairpinMfe(seq)
+	}
+	return math.Min(m.HairpinMfe(seq[:m.FoldWindow]), m.HairpinMfe(seq[len(seq)-m.FoldWindow:]))
+}
+
+// Length of the longest homopolymer run, ambiguous bases are ignored:
+func LongestHomopolymer(seq string) int {
+	var max, run int
+	for i := 0; i < len(seq); i++ {
+		if seq[i] == 'N' {
+			run = 0
+			continue
+		}
+		if i > 0 && seq[i] == seq[i-1] {
+			run++
+		} else {
+			run = 1
+		}
+		if run > max {
+			max = run
+		}
+	}
+	return max
+}
+
+// Multiplicative efficiency factor of the sequence features:
+func (m SeqFeatureModel) Factor(seq string) (factor float64, mfe float64, homo int) {
+	factor = 1.0
+	if m.FoldMode != "" {
+		mfe = m.Mfe(seq)
+		factor *= math.Exp(mfe / m.FoldScale)
+	}
+	homo = LongestHomopolymer(seq)
+	if m.HomoPenalty > 0.0 && homo >= m.HomoMin {
+		factor *= math.Pow(1.0-m.HomoPenalty, float64(homo-m.HomoMin+1))
+	}
+	return
+}
+
+// Write out the contribution of the sequence features to the efficiency of a fragment:
+func (m SeqFeatureModel) Record(tr Transcripter, start uint32, end uint32, count uint64, mfe float64, homo int, factor float64) {
+	if m.out == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(m.out, "%s\t%d\t%d\t%d\t%.2f\t%d\t%g\n", tr.GetName(), start, end, count, mfe, homo, factor)
+}
+
+func (m *SeqFeatureModel) Close() {
+	if m == nil || m.out == nil {
+		return
+	}
+	m.out.Flush()
+	m.file.Close()
+	L.PrintfV("Sequence feature efficiencies written to %s.", m.file.Name())
+}
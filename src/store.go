@@ -0,0 +1,292 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// Name of the store file within the store directory:
+const storeFileName = "fragments.store"
+
+// Size of the record headers: transcript id and payload length.
+const storeHeaderLen = 16
+
+// Minimum size of the store before outdated records are compacted:
+const storeCompactMin = 1 << 24
+
+// Single append-only file holding the compressed fragment tables of all transcripts.
+// Every record starts with the transcript id and the payload length, and the index
+// points to the latest record of every transcript. Records are only referenced after
+// they were written completely, so a live record is never overwritten. When outdated
+// records make up more than half of the store, the live records are copied into a
+// new file, which then replaces the store:
+type FragStore struct {
+	Path      string
+	file      **os.File
+	end       *int64
+	outdated  *int64 // Bytes held by outdated records.
+	nrCompact *int
+	index     map[uint64]storeEntry
+	lock      *sync.Mutex   // Guards the index and the sizes.
+	fileLock  *sync.RWMutex // Held exclusively while the store is compacted.
+	mapLock   *sync.RWMutex
+	mapped    *[]byte // Memory mapped contents, nil when reading through the file.
+	mmap      bool
+	Budget    *MemBudget // Keep idle fragment tables in memory up to this budget.
+}
+
+// Contents of a record:
+type storeRecord struct {
+	Frags    map[uint32]StartEndCountStruct
+	Variants []FragVariant // The first element is a placeholder for fragments without variants.
+}
+
+type storeEntry struct {
+	Offset int64 // Offset of the payload.
+	Len    int64
+}
+
+func NewFragStore(dir string, mmap bool) *FragStore {
+	s := new(FragStore)
+	s.Path = path.Join(dir, storeFileName)
+	f, err := os.OpenFile(s.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		L.Fatalf("Could not create fragment store \"%s\": %s", s.Path, err.Error())
+	}
+	s.file = &f
+	s.end = new(int64)
+	s.outdated = new(int64)
+	s.nrCompact = new(int)
+	s.index = make(map[uint64]storeEntry)
+	s.lock = new(sync.Mutex)
+	s.fileLock = new(sync.RWMutex)
+	s.mapLock = new(sync.RWMutex)
+	s.mapped = new([]byte)
+	if mmap && !mmapSupported {
+		L.Println("WARNING: Memory mapping is not supported on this platform, the fragment store is read through the file.")
+		mmap = false
+	}
+	s.mmap = mmap
+	return s
+}
+
+// Append the compressed fragment table and the fragment variants of a transcript:
+func (s FragStore) Put(id uint64, frags map[uint32]StartEndCountStruct, vars []*FragVariant) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, storeHeaderLen))
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		L.Fatalf("Failed to compress fragments: %s", err.Error())
+	}
+	if err = gob.NewEncoder(w).Encode(storeRecord{frags, variantValues(vars)}); err != nil {
+		L.Fatalf("Failed to encode fragments for transcript %d: %s", id, err.Error())
+	}
+	w.Close()
+	rec := buf.Bytes()
+	payload := int64(len(rec) - storeHeaderLen)
+	binary.LittleEndian.PutUint64(rec[0:8], id)
+	binary.LittleEndian.PutUint64(rec[8:16], uint64(payload))
+
+	s.fileLock.RLock()
+	s.lock.Lock()
+	off := *s.end
+	*s.end += int64(len(rec))
+	s.lock.Unlock()
+
+	if _, err = (*s.file).WriteAt(rec, off); err != nil {
+		L.Fatalf("Failed to write fragment store \"%s\": %s", s.Path, err.Error())
+	}
+
+	// Point to the new record once it is written:
+	s.lock.Lock()
+	if old, ok := s.index[id]; ok {
+		*s.outdated += old.Len + storeHeaderLen
+	}
+	s.index[id] = storeEntry{Offset: off + storeHeaderLen, Len: payload}
+	compact := s.needsCompaction()
+	s.lock.Unlock()
+	s.fileLock.RUnlock()
+
+	if compact {
+		s.compact()
+	}
+}
+
+// True if the outdated records should be dropped:
+func (s FragStore) needsCompaction() bool {
+	return *s.end >= storeCompactMin && 2*(*s.outdated) > *s.end
+}
+
+// Copy the live records into a new file and replace the store with it:
+func (s FragStore) compact() {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// The store might have been compacted by an other writer meanwhile:
+	if !s.needsCompaction() {
+		return
+	}
+
+	tmpPath := s.Path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		L.Fatalf("Could not create fragment store \"%s\": %s", tmpPath, err.Error())
+	}
+	// Copy the records in the order of their offsets:
+	ids := make([]uint64, 0, len(s.index))
+	for id := range s.index {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return s.index[ids[i]].Offset < s.index[ids[j]].Offset })
+	var end int64
+	for _, id := range ids {
+		e := s.index[id]
+		rec := make([]byte, e.Len+storeHeaderLen)
+		if _, err := (*s.file).ReadAt(rec, e.Offset-storeHeaderLen); err != nil {
+			L.Fatalf("Failed to read fragment store \"%s\": %s", s.Path, err.Error())
+		}
+		if _, err := f.WriteAt(rec, end); err != nil {
+			L.Fatalf("Failed to write fragment store \"%s\": %s", tmpPath, err.Error())
+		}
+		s.index[id] = storeEntry{Offset: end + storeHeaderLen, Len: e.Len}
+		end += int64(len(rec))
+	}
+	if err := os.Rename(tmpPath, s.Path); err != nil {
+		L.Fatalf("Could not replace fragment store \"%s\": %s", s.Path, err.Error())
+	}
+
+	s.unmap()
+	(*s.file).Close()
+	*s.file = f
+	L.PrintfV("Compacted fragment store from %d to %d bytes.", *s.end, end)
+	*s.end = end
+	*s.outdated = 0
+	*s.nrCompact++
+}
+
+// Load the fragment table and the fragment variants of a transcript:
+func (s FragStore) Get(id uint64) (map[uint32]StartEndCountStruct, []*FragVariant) {
+	s.fileLock.RLock()
+	defer s.fileLock.RUnlock()
+	s.lock.Lock()
+	e, ok := s.index[id]
+	s.lock.Unlock()
+	if !ok {
+		L.Fatalf("Transcript %d is missing from the fragment store!", id)
+	}
+
+	var r io.Reader
+	if s.mmap {
+		s.mapLock.RLock()
+		if e.Offset+e.Len > int64(len(*s.mapped)) {
+			// The store grew since it was mapped:
+			s.mapLock.RUnlock()
+			s.remap()
+			s.mapLock.RLock()
+		}
+		defer s.mapLock.RUnlock()
+		r = bytes.NewReader((*s.mapped)[e.Offset : e.Offset+e.Len])
+	} else {
+		r = io.NewSectionReader(*s.file, e.Offset, e.Len)
+	}
+	fr := flate.NewReader(r)
+	defer fr.Close()
+	var rec storeRecord
+	if err := gob.NewDecoder(fr).Decode(&rec); err != nil {
+		L.Fatalf("Failed to decode fragments for transcript %d: %s", id, err.Error())
+	}
+	if rec.Frags == nil {
+		rec.Frags = make(map[uint32]StartEndCountStruct)
+	}
+	return rec.Frags, variantPointers(rec.Variants)
+}
+
+// Map the current contents of the store:
+func (s FragStore) remap() {
+	s.mapLock.Lock()
+	defer s.mapLock.Unlock()
+	fi, err := (*s.file).Stat()
+	if err != nil {
+		L.Fatalf("Could not stat fragment store \"%s\": %s", s.Path, err.Error())
+	}
+	if fi.Size() <= int64(len(*s.mapped)) {
+		return
+	}
+	if len(*s.mapped) > 0 {
+		munmapFile(*s.mapped)
+	}
+	m, err := mmapFile(*s.file, int(fi.Size()))
+	if err != nil {
+		L.Fatalf("Could not memory map fragment store \"%s\": %s", s.Path, err.Error())
+	}
+	*s.mapped = m
+}
+
+// Drop the mapping of the store:
+func (s FragStore) unmap() {
+	s.mapLock.Lock()
+	defer s.mapLock.Unlock()
+	if len(*s.mapped) > 0 {
+		munmapFile(*s.mapped)
+		*s.mapped = nil
+	}
+}
+
+// Drop a transcript from the store, its record becomes outdated:
+func (s FragStore) Delete(id uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.index[id]; ok {
+		*s.outdated += e.Len + storeHeaderLen
+		delete(s.index, id)
+	}
+}
+
+// Close and remove the store:
+func (s FragStore) Remove() {
+	L.PrintfV("Fragment store size: %d bytes, outdated: %d bytes, compactions: %d.", *s.end, *s.outdated, *s.nrCompact)
+	if s.Budget != nil {
+		s.Budget.LogUsage()
+	}
+	s.unmap()
+	(*s.file).Close()
+	if err := os.Remove(s.Path); err != nil {
+		L.Fatalf("Could not remove fragment store \"%s\": %s", s.Path, err.Error())
+	}
+}
@@ -28,6 +28,8 @@
 
 package main
 
+import "sort"
+
 type Targeter interface {
 	SampleMixComp(rand Rander) *MixComp
 	NextLenCount() (length uint32, count uint64, ok bool)
@@ -43,6 +45,19 @@ type LenCountStruct struct {
 	Count  []uint64
 }
 
+func (s LenCountStruct) Len() int {
+	return len(s.Length)
+}
+
+func (s LenCountStruct) Less(i, j int) bool {
+	return s.Length[i] < s.Length[j]
+}
+
+func (s LenCountStruct) Swap(i, j int) {
+	s.Length[i], s.Length[j] = s.Length[j], s.Length[i]
+	s.Count[i], s.Count[j] = s.Count[j], s.Count[i]
+}
+
 type Target struct {
 	ReqFrags      int64
 	TargetMix     *TargetMix
@@ -120,6 +135,8 @@ func (tg Target) SampleLengths(rand Rander) {
 		delete(tmp, length)
 		i++
 	}
+	// Order by length, so the transcripts are sampled reproducibly:
+	sort.Sort(lcs)
 }
 
 func (tg Target) NextLenCount() (length uint32, count uint64, ok bool) {
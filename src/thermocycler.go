@@ -28,22 +28,34 @@
 
 package main
 
-import "math"
+import (
+	"math"
+	"sort"
+)
 
 type Thermocycler interface {
 	Pcr(tr Transcripter, p Pooler, st FragStater, rand Rander)
+	PoolWide() bool
+	PcrPool(trs []Transcripter, p Pooler, st FragStater, workers int, seed int64)
 	ReportEffFunctions(tg Targeter, rep Reporter)
+	CompareApprox(rep Reporter, rand Rander)
 }
 
 type Techne struct {
 	NrCycles    int64
 	FixedEff    float64
-	GcEffParam  *EffParam
+	GcModel     GcModel
+	GcWindow    uint32 // Window size for local GC content, zero for the whole fragment.
+	Surface     *EffSurface
 	LenEffParam *EffParam
 	Target      Targeter
 	LenScalers  *LenScalers
-	RawGcEffs   []float64
-	hasRawEffs  bool
+	Errors      *PcrErrorModel
+	Chimeras    *PcrChimeraModel
+	Features    *SeqFeatureModel
+	Capacity    float64 // Total molecules at the plateau, zero for unlimited reagents.
+	// Counts above the threshold are amplified approximately, zero for exact amplification:
+	ApproxThreshold uint64
 }
 
 type LenScalers struct {
@@ -51,8 +63,21 @@ type LenScalers struct {
 	B float64
 }
 
-func NewTechne(NrCycles int64, FixedEff float64, gcEffParam *EffParam, rawGcEffs []float64, minRawGcEff float64, lenEffParam *EffParam, tg Targeter) *Techne {
+func NewTechne(NrCycles int64, FixedEff float64, surface *EffSurface, gcModel GcModel, gcWindow int, gcEffParam *EffParam, rawGcEffs []float64, minRawGcEff float64, lenEffParam *EffParam, tg Targeter, errors *PcrErrorModel, chimeras *PcrChimeraModel, features *SeqFeatureModel, capacity float64, approxThreshold uint64) *Techne {
 	tn := new(Techne)
+	tn.ApproxThreshold = approxThreshold
+	if approxThreshold > 0 {
+		L.PrintfV("Approximating amplification above %d molecules.", approxThreshold)
+	}
+	tn.Capacity = capacity
+	if capacity > 0.0 {
+		L.PrintfV("Amplifying the whole pool together, plateau capacity: %g molecules", capacity)
+	} else if capacity < 0.0 {
+		L.Fatalf("The plateau capacity must be non-negative!")
+	}
+	tn.Errors = errors
+	tn.Chimeras = chimeras
+	tn.Features = features
 	tn.NrCycles = NrCycles
 	L.PrintfV("Number of PCR cycles: %d", NrCycles)
 	tn.FixedEff = FixedEff
@@ -61,15 +86,27 @@ func NewTechne(NrCycles int64, FixedEff float64, gcEffParam *EffParam, rawGcEffs
 		L.PrintfV("Using fixed amplifcation efficiency: %g", FixedEff)
 	} else {
 
-		if rawGcEffs != nil {
+		if surface != nil {
+			L.PrintfV("Using a joint GC and length efficiency surface with %d GC and %d length bins.", len(surface.Gc), len(surface.Length))
+			tn.Surface = surface
+		} else if gcModel != nil {
+			L.PrintfV("GC efficiency model: %s", gcModel)
+			tn.GcModel = gcModel
+		} else if rawGcEffs != nil {
 			// Got raw gc efficiencies:
 			L.PrintfV("Using raw GC efficiencies with a minimum efficiency: %g", minRawGcEff)
-			tn.RawGcEffs = tn.ProcessRawGcEffs(rawGcEffs, minRawGcEff)
-			tn.hasRawEffs = true
+			tn.GcModel = RawGcModel{tn.ProcessRawGcEffs(rawGcEffs, minRawGcEff)}
 		} else {
 			L.PrintfV("GC dependent efficiency parameters: (%g,%g,%g)", gcEffParam.Shape, gcEffParam.Min, gcEffParam.Max)
 			L.PrintfV("Length dependent efficiency parameters: (%g,%g,%g)", lenEffParam.Shape, lenEffParam.Min, lenEffParam.Max)
-			tn.GcEffParam = gcEffParam
+			tn.GcModel = ShapeGcModel{gcEffParam}
+		}
+		if gcWindow < 0 {
+			L.Fatalf("The GC window size must be non-negative!")
+		}
+		tn.GcWindow = uint32(gcWindow)
+		if gcWindow > 0 {
+			L.PrintfV("Using the GC extremes of %d base windows.", gcWindow)
 		}
 
 		tn.LenEffParam = lenEffParam
@@ -105,8 +142,21 @@ func (tn Techne) ProcessRawGcEffs(effs []float64, minEff float64) []float64 {
 
 func (tn Techne) Pcr(tr Transcripter, p Pooler, st FragStater, rand Rander) {
 	frags := tr.GetFragStructs()
-	// Iterate over lengths:
-	for length, sec := range *frags {
+	// Iterate over lengths in a fixed order:
+	lengths := make([]int, 0, len(*frags))
+	for length := range *frags {
+		lengths = append(lengths, int(length))
+	}
+	sort.Ints(lengths)
+	totals := make(map[uint32]uint64, len(lengths))
+	// Molecule counts after every cycle:
+	traj := NewPcrTrajectory()
+	curve := make([]uint64, tn.NrCycles+1)
+	// Clones of other lengths, such as copies carrying indels, are registered after amplifying all lengths:
+	others := make([]*pcrClone, 0)
+	for _, l := range lengths {
+		length := uint32(l)
+		sec := (*frags)[length]
 		// Total fragments with current length:
 		total := uint64(0)
 		// Calculate length efficiency:
@@ -117,35 +167,258 @@ func (tn Techne) Pcr(tr Transcripter, p Pooler, st FragStater, rand Rander) {
 		size := len(sec.Count)
 		// Iterate over fragments:
 		for i := 0; i < size; i++ {
+			gcBin, lenBin := tn.trajBins(tr.GcContent(sec.Start[i], sec.End[i]), length)
 			// Amplify fragment:
-			ampliCount := tn.AmplifyFragment(tr, sec.Start[i], sec.End[i], sec.Count[i], lengthEff, rand)
-			// Update fragment count:
-			sec.Count[i] = ampliCount
+			var ampliCount uint64
+			if tn.Errors.Active() {
+				var clones []*pcrClone
+				ampliCount, clones = tn.AmplifyFragmentClones(tr, &sec, i, lengthEff, curve, st, rand)
+				others = append(others, clones...)
+			} else {
+				ampliCount = tn.AmplifyFragment(tr, sec.Start[i], sec.End[i], sec.Count[i], lengthEff, curve, st, rand)
+				// Update fragment count:
+				sec.Count[i] = ampliCount
+			}
+			traj.Add(gcBin, lenBin, curve)
 			total += ampliCount
 		}
+		// Store fragments carrying PCR errors:
+		(*frags)[length] = sec
+		totals[length] = total
+	}
+
+	// Store the clones of other lengths:
+	for _, cl := range others {
+		length := uint32(len(cl.seq))
+		sec, ok := (*frags)[length]
+		if !ok {
+			lengths = append(lengths, int(length))
+		}
+		sec.Start = append(sec.Start, cl.start)
+		sec.End = append(sec.End, cl.end)
+		sec.Var = append(sec.Var, cl.idx)
+		sec.Count = append(sec.Count, cl.count)
+		(*frags)[length] = sec
+		totals[length] += cl.count
+	}
+	sort.Ints(lengths)
+	st.UpdatePcrTrajectory(traj)
+
+	for _, l := range lengths {
+		length := uint32(l)
 		// Register into pool:
-		p.RegisterFragments(tr, length, total)
+		p.RegisterFragments(tr, length, totals[length])
 		// Update AfterPcr stats:
-		st.UpdateAfterPcr(length, total)
+		st.UpdateAfterPcr(length, totals[length])
 	}
 }
 
-func (tn Techne) AmplifyFragment(tr Transcripter, start uint32, end uint32, icount uint64, lengthE float64, rand Rander) uint64 {
-	e := tn.FixedEff
-	var oldIcount uint64
-	if e == 0.0 {
-		e = lengthE * tn.CalcGcEff(tr, start, end)
+// Efficiency of a pre-PCR fragment, the contribution of the sequence features is recorded:
+func (tn Techne) fragEff(tr Transcripter, start uint32, end uint32, count uint64, lengthE float64, st FragStater) float64 {
+	e := tn.baseFragEff(tr, start, end, lengthE)
+	if tn.Features.Active() {
+		factor, mfe, homo := tn.Features.Factor(tr.SubSeq(start, end))
+		st.UpdateSeqFeatures(factor, count)
+		tn.Features.Record(tr, start, end, count, mfe, homo, factor)
+		e *= factor
+	}
+	return e
+}
+
+func (tn Techne) baseFragEff(tr Transcripter, start uint32, end uint32, lengthE float64) float64 {
+	if tn.FixedEff != 0.0 {
+		return tn.FixedEff
+	}
+	if tn.Surface != nil {
+		if tn.GcWindow > 0 {
+			lo, hi := tr.GcWindowRange(start, end, tn.GcWindow)
+			return tn.Surface.RangeEff(lo, hi, end-start)
+		}
+		return tn.Surface.Eff(tr.GcContent(start, end), end-start)
+	}
+	return lengthE * tn.CalcGcEff(tr, start, end)
+}
+
+// Efficiency of a fragment given by its sequence:
+func (tn Techne) seqEff(seq string, lengthE float64) float64 {
+	if tn.FixedEff != 0.0 {
+		return tn.FixedEff
 	}
+	if tn.Surface != nil {
+		w := len(seq)
+		if tn.GcWindow > 0 {
+			w = int(tn.GcWindow)
+		}
+		lo, hi := SeqGcRange(seq, w)
+		return tn.Surface.RangeEff(lo, hi, uint32(len(seq)))
+	}
+	return lengthE * tn.CalcSeqGcEff(seq)
+}
+
+// Amplify a fragment, the counts after every cycle are stored in curve:
+func (tn Techne) AmplifyFragment(tr Transcripter, start uint32, end uint32, icount uint64, lengthE float64, curve []uint64, st FragStater, rand Rander) uint64 {
+	e := tn.fragEff(tr, start, end, icount, lengthE, st)
+	var oldIcount uint64
+	curve[0] = icount
 	for i := int64(0); i < tn.NrCycles; i++ {
+		// Approximate the remaining cycles for large counts:
+		if tn.ApproxThreshold > 0 && icount >= tn.ApproxThreshold {
+			curve[tn.NrCycles] = tn.ApproxAmplify(icount, e, tn.NrCycles-i, rand)
+			interpolateCurve(curve, i)
+			return curve[tn.NrCycles]
+		}
 		oldIcount = icount
 		icount += rand.Binomial(icount, e)
 		if icount < oldIcount {
 			L.Fatal("Integer overflow detected when amplifying fragments!")
 		}
+		curve[i+1] = icount
 	}
 	return icount
 }
 
+// Copies of a fragment sharing the same sequence, or pending copies carrying new errors:
+type pcrClone struct {
+	start   uint32
+	end     uint32
+	variant *FragVariant
+	idx     uint32 // Index of the variant in the transcript.
+	count   uint64
+	eff     float64
+	pErr    float64
+	seq     string // Template sequence without PCR errors.
+}
+
+// Kind of templates whose faulty copies share pending lineages within a cycle:
+type pendingKey struct {
+	start    uint32
+	end      uint32
+	length   uint32
+	chimeric bool
+}
+
+// Set the template sequence and the amplification parameters of a clone. The
+// contribution of the sequence features is recorded if st is not nil:
+func (tn Techne) initClone(tr Transcripter, cl *pcrClone, lengthE float64, st FragStater) {
+	cl.seq = cl.variant.Template(tr, cl.start, cl.end)
+	if cl.variant != nil {
+		cl.seq = cl.variant.WithErrors(nil).Apply(cl.seq)
+	}
+	length := uint32(len(cl.seq))
+	if lengthE == 0.0 && tn.FixedEff == 0.0 {
+		lengthE = tn.CalcLengthEff(length)
+	}
+	cl.eff = tn.seqEff(cl.seq, lengthE)
+	if tn.Features.Active() {
+		factor, mfe, homo := tn.Features.Factor(cl.seq)
+		if st != nil {
+			st.UpdateSeqFeatures(factor, cl.count)
+			tn.Features.Record(tr, cl.start, cl.end, cl.count, mfe, homo, factor)
+		}
+		cl.eff *= factor
+	}
+	if tn.Errors.Active() {
+		cl.pErr = tn.Errors.ErrorProb(length + cl.variant.UmiLen())
+	}
+}
+
+// Add faulty copies of a clone to the pending copies made in the current cycle from
+// templates of the same kind. The new pending clone is returned if one was created:
+func (tn Techne) addFaulty(tr Transcripter, pending map[pendingKey]*pcrClone, cl *pcrClone, n uint64, rand Rander) *pcrClone {
+	key := pendingKey{cl.start, cl.end, uint32(len(cl.seq)), cl.variant != nil && cl.variant.Junction != nil}
+	if pc, ok := pending[key]; ok {
+		pc.variant.Pending.Add(cl.idx, n)
+		pc.count += n
+		return nil
+	}
+	// The pending variant keeps the sites, lineage, junction and UMI of the first template:
+	v := cl.variant.WithErrors(nil)
+	v.Pending = &PcrPending{Seed: rand.Int63(), Errors: tn.Errors}
+	v.Pending.Add(cl.idx, n)
+	pc := &pcrClone{start: cl.start, end: cl.end, variant: v, idx: tr.AddVariant(v), count: n, eff: cl.eff, pErr: cl.pErr, seq: cl.seq}
+	pending[key] = pc
+	return pc
+}
+
+// Simulate the template switch of a copy, copies of pending lineages carry the errors of
+// the drawn lineage:
+func (tn Techne) switchClone(tr Transcripter, templates *pcrTemplates, cl *pcrClone, st FragStater, rand Rander) (*pcrClone, bool) {
+	src := cl
+	if cl.variant != nil && cl.variant.Pending != nil {
+		tmp := *cl
+		tmp.variant = tr.DrawVariant(cl.idx, cl.start, cl.end, cl.count, false, rand)
+		src = &tmp
+	}
+	nc, ok := tn.Chimeras.Switch(tr, templates, src, rand)
+	if !ok {
+		return nil, false
+	}
+	tn.initClone(tr, nc, 0.0, nil)
+	nc.idx = tr.AddVariant(nc.variant)
+	// Products collinear with their source are not chimeras:
+	if j := nc.variant.Junction; j != nil {
+		st.UpdatePcrChimera(j)
+	}
+	return nc, true
+}
+
+// Amplify a fragment while simulating polymerase errors. Copies
+// carrying new errors are pooled into pending clones, which inherit the errors of their
+// templates and are amplified in the following cycles. The clones having the length of
+// the fragment are appended to the fragment structure, the others are returned. The
+// total counts of the clones after every cycle are stored in curve:
+func (tn Techne) AmplifyFragmentClones(tr Transcripter, sec *StartEndCountStruct, i int, lengthE float64, curve []uint64, st FragStater, rand Rander) (uint64, []*pcrClone) {
+	start, end := sec.Start[i], sec.End[i]
+	first := &pcrClone{start: start, end: end, variant: tr.GetVariant(sec.Var[i]), idx: sec.Var[i], count: sec.Count[i]}
+	tn.initClone(tr, first, lengthE, st)
+
+	clones := []*pcrClone{first}
+	curve[0] = first.count
+	for c := int64(0); c < tn.NrCycles; c++ {
+		pending := make(map[pendingKey]*pcrClone)
+		size := len(clones)
+		for j := 0; j < size; j++ {
+			cl := clones[j]
+			copies := tn.DrawCopies(cl.count, cl.eff, rand)
+			if cl.count+copies < cl.count {
+				L.Fatal("Integer overflow detected when amplifying fragments!")
+			}
+			var faulty uint64
+			if cl.pErr > 0.0 {
+				faulty = rand.Binomial(copies, cl.pErr)
+			}
+			cl.count += copies - faulty
+
+			if faulty > 0 {
+				if pc := tn.addFaulty(tr, pending, cl, faulty, rand); pc != nil {
+					clones = append(clones, pc)
+				}
+			}
+		}
+		curve[c+1] = 0
+		for _, cl := range clones {
+			curve[c+1] += cl.count
+		}
+	}
+
+	// Register the clones:
+	sec.Count[i] = first.count
+	total := first.count
+	others := make([]*pcrClone, 0)
+	for _, cl := range clones[1:] {
+		if len(cl.seq) != len(first.seq) {
+			others = append(others, cl)
+			continue
+		}
+		sec.Start = append(sec.Start, cl.start)
+		sec.End = append(sec.End, cl.end)
+		sec.Var = append(sec.Var, cl.idx)
+		sec.Count = append(sec.Count, cl.count)
+		total += cl.count
+	}
+	return total, others
+}
+
 func (tn Techne) CalcLengthEff(l uint32) (e float64) {
 	shape := tn.LenEffParam.Shape
 	if shape == 0.0 {
@@ -156,7 +429,16 @@ func (tn Techne) CalcLengthEff(l uint32) (e float64) {
 }
 
 func (tn Techne) CalcGcEff(tr Transcripter, start uint32, end uint32) (e float64) {
-	seq := tr.GetSeq()[start:end]
+	if tn.GcWindow > 0 {
+		return tn.windowGcEff(tr.GcWindowRange(start, end, tn.GcWindow))
+	}
+	return tn.CalcGcEffFixed(tr.GcContent(start, end))
+}
+
+func (tn Techne) CalcSeqGcEff(seq string) (e float64) {
+	if tn.GcWindow > 0 {
+		return tn.windowGcEff(SeqGcRange(seq, int(tn.GcWindow)))
+	}
 	// Calculate GC content:
 	var gc float64
 	for i := 0; i < len(seq); i++ {
@@ -166,36 +448,26 @@ func (tn Techne) CalcGcEff(tr Transcripter, start uint32, end uint32) (e float64
 	}
 	gc = gc / float64(len(seq))
 
-	if tn.hasRawEffs {
-		return tn.RawGcEffs[int(gc*100.0)]
-	}
-
-	min := tn.GcEffParam.Min
-	max := tn.GcEffParam.Max
-	shape := tn.GcEffParam.Shape
-
-	eff := min + (max-min)*math.Pow((1-math.Pow(gc, shape)), shape)
+	return tn.CalcGcEffFixed(gc)
+}
 
-	return eff
+// The efficiency is limited by the most extreme window:
+func (tn Techne) windowGcEff(lo float64, hi float64) float64 {
+	return math.Min(tn.CalcGcEffFixed(lo), tn.CalcGcEffFixed(hi))
 }
 
 func (tn Techne) CalcGcEffFixed(gc float64) (e float64) {
-	if tn.hasRawEffs {
-		return tn.RawGcEffs[int(gc*100)]
-	}
-	min := tn.GcEffParam.Min
-	max := tn.GcEffParam.Max
-	shape := tn.GcEffParam.Shape
-
-	eff := min + (max-min)*math.Pow((1-math.Pow(gc, shape)), shape)
-
-	return eff
+	return tn.GcModel.Eff(gc)
 }
 
 func (tn Techne) ReportEffFunctions(tg Targeter, rep Reporter) {
 	if tn.FixedEff > 0.0 {
 		return
 	}
+	if tn.Surface != nil {
+		tn.Surface.Report(tg, rep)
+		return
+	}
 	// Report GC efficiency function:
 	var x [201]float64
 	var y [201]float64
@@ -0,0 +1,153 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Width of the GC content bins (%) and the number of length bins of the amplification curves:
+const trajGcBin = 10
+const trajLenBins = 8
+
+// Molecule counts after every PCR cycle, broken down by GC content and length:
+type PcrTrajectory struct {
+	Gc  map[uint32][]uint64 // Keyed by the lower bound of the GC bin (%).
+	Len map[uint32][]uint64 // Keyed by the lower bound of the length bin.
+}
+
+func NewPcrTrajectory() *PcrTrajectory {
+	return &PcrTrajectory{make(map[uint32][]uint64), make(map[uint32][]uint64)}
+}
+
+// Bins of a fragment with a given GC content and length:
+func (tn Techne) trajBins(gc float64, length uint32) (gcBin uint32, lenBin uint32) {
+	gcBin = uint32(gc*100.0) / trajGcBin * trajGcBin
+	if gcBin >= 100 {
+		gcBin = 100 - trajGcBin
+	}
+	low, high := uint32(tn.Target.GetLow()), uint32(tn.Target.GetHigh())
+	w := (high - low + trajLenBins) / trajLenBins
+	if w == 0 {
+		w = 1
+	}
+	switch {
+	case length <= low:
+		lenBin = low
+	case length >= high:
+		lenBin = low + (high-low)/w*w
+	default:
+		lenBin = low + (length-low)/w*w
+	}
+	return
+}
+
+// Add molecules to the bins at a given cycle, cycle zero holds the templates:
+func (t *PcrTrajectory) AddCount(gcBin uint32, lenBin uint32, cycles int64, cycle int64, count uint64) {
+	addCurveCount(t.Gc, gcBin, cycles, cycle, count)
+	addCurveCount(t.Len, lenBin, cycles, cycle, count)
+}
+
+func addCurveCount(m map[uint32][]uint64, bin uint32, cycles int64, cycle int64, count uint64) {
+	c, ok := m[bin]
+	if !ok {
+		c = make([]uint64, cycles+1)
+		m[bin] = c
+	}
+	c[cycle] += count
+}
+
+// Add the counts of a fragment after every cycle:
+func (t *PcrTrajectory) Add(gcBin uint32, lenBin uint32, curve []uint64) {
+	cycles := int64(len(curve) - 1)
+	for i, count := range curve {
+		t.AddCount(gcBin, lenBin, cycles, int64(i), count)
+	}
+}
+
+func (t *PcrTrajectory) Merge(o *PcrTrajectory) {
+	for _, m := range [][2]map[uint32][]uint64{{t.Gc, o.Gc}, {t.Len, o.Len}} {
+		for bin, curve := range m[1] {
+			c, ok := m[0][bin]
+			if !ok {
+				c = make([]uint64, len(curve))
+				m[0][bin] = c
+			}
+			for i, count := range curve {
+				c[i] += count
+			}
+		}
+	}
+}
+
+// Fill in the counts of the cycles simulated at once by geometric interpolation:
+func interpolateCurve(curve []uint64, from int64) {
+	last := int64(len(curve) - 1)
+	if from >= last || curve[from] == 0 {
+		return
+	}
+	r := float64(curve[last]) / float64(curve[from])
+	for j := from + 1; j < last; j++ {
+		curve[j] = uint64(float64(curve[from])*math.Pow(r, float64(j-from)/float64(last-from)) + 0.5)
+	}
+}
+
+// Report the amplification curves by GC content and length bins:
+func (t *PcrTrajectory) Report(rep Reporter) {
+	if len(t.Gc) == 0 {
+		return
+	}
+	reportCurves(t.Gc, "GC content (%)", "Amplification curves by GC content", rep)
+	reportCurves(t.Len, "Length", "Amplification curves by length", rep)
+}
+
+func reportCurves(m map[uint32][]uint64, yl string, title string, rep Reporter) {
+	bins := make([]int, 0, len(m))
+	var cycles int
+	for bin, curve := range m {
+		bins = append(bins, int(bin))
+		cycles = len(curve)
+	}
+	sort.Ints(bins)
+	x := make([]float64, cycles)
+	for i := range x {
+		x[i] = float64(i)
+	}
+	y := make([]uint32, len(bins))
+	z := make([][]float64, len(bins))
+	for i, bin := range bins {
+		y[i] = uint32(bin)
+		z[i] = make([]float64, cycles)
+		for j, count := range m[uint32(bin)] {
+			z[i][j] = float64(count)
+		}
+	}
+	rep.ReportMatrix(x, y, z, "Cycle", yl, title, "curves")
+}
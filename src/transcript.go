@@ -29,24 +29,35 @@
 package main
 
 import (
-	"encoding/gob"
 	"fmt"
-	"os"
-	"path"
-	"strings"
+	"sort"
+	"sync"
 )
 
 type Transcripter interface {
+	GetId() uint64
 	GetName() string
 	GetSeq() string
 	GetRevSeq() string
+	SubSeq(start uint32, end uint32) string
+	RevSubSeq(start uint32, end uint32) string
+	GetPackedSeq(reverse bool) *PackedSeq
 	SimulatePolyA(polyAParam *TargetMix, polyAmax int, st FragStater, rand Rander) int
 	GetExprLevel() uint64
 	GetLen() uint32
-	RegisterFragment(length uint32, start uint32, end uint32)
+	GcContent(start uint32, end uint32) float64
+	GcWindowRange(start uint32, end uint32, w uint32) (float64, float64)
+	JettisonGcCache()
+	RegisterFragment(length uint32, start uint32, end uint32, v *FragVariant) bool
+	GetVariant(i uint32) *FragVariant
+	DrawVariant(i uint32, start uint32, end uint32, count uint64, take bool, rand Rander) *FragVariant
+	AddVariant(v *FragVariant) uint32
+	GetOrigin() string
+	EnableLineage()
 	SampleFragment(length uint32, rand Rander) Fragment
 	Flatten()
-	Fragment(tg Targeter, fg Fragmentor, polyAparam *TargetMix, polyAmax int, st FragStater, rand Rander)
+	AttachUmis(m *UmiModel, rand Rander)
+	Fragment(tg Targeter, fg Fragmentor, polyAparam *TargetMix, polyAmax int, capture *PolyACapture, st FragStater, rand Rander)
 	Pcr(p Pooler, tc Thermocycler, st FragStater, rand Rander)
 	GetFragStructs() *map[uint32]StartEndCountStruct
 	String() string
@@ -56,26 +67,67 @@ type Transcripter interface {
 	JettisonFragStructs()
 }
 
-type EndCountMap map[uint32]uint64
+// Fragment end and variant index:
+type FragEnd struct {
+	End uint32
+	Var uint32
+}
+
+type EndCountMap map[FragEnd]uint64
 type StartEndCountMap map[uint32]EndCountMap
 type StartEndCountStruct struct {
 	Start []uint32
 	End   []uint32
+	Var   []uint32
 	Count []uint64
 }
 
-type Transcript struct {
-	id   uint64
-	name string
-	seq  struct {
-		plus  string
-		minus string
+// Sort fragments by start, end and variant, so the order does not depend on map iteration:
+func (s StartEndCountStruct) Len() int {
+	return len(s.Start)
+}
+
+func (s StartEndCountStruct) Less(i, j int) bool {
+	if s.Start[i] != s.Start[j] {
+		return s.Start[i] < s.Start[j]
 	}
+	if s.End[i] != s.End[j] {
+		return s.End[i] < s.End[j]
+	}
+	return s.Var[i] < s.Var[j]
+}
+
+func (s StartEndCountStruct) Swap(i, j int) {
+	s.Start[i], s.Start[j] = s.Start[j], s.Start[i]
+	s.End[i], s.End[j] = s.End[j], s.End[i]
+	s.Var[i], s.Var[j] = s.Var[j], s.Var[i]
+	s.Count[i], s.Count[j] = s.Count[j], s.Count[i]
+}
+
+type Transcript struct {
+	id          uint64
+	name        string
+	seq         *TrSeq
 	len         uint32
 	exprLevel   uint64
-	gobFile     string
+	store       *FragStore // Store of the fragments, nil if kept in memory.
 	FragMap     *map[uint32]StartEndCountMap
 	FragStructs *map[uint32]StartEndCountStruct
+	Variants    *[]*FragVariant // The first element is reserved for fragments without variants.
+	varIndex    *map[string]uint32
+	varLock     *sync.Mutex // Guards the resolution of pending variants.
+	lineage     *LineageState
+	origin      string      // Empty for transcriptome molecules.
+	depletion   *Depletion  // Depletion of contaminating molecules.
+	digested    *[]Interval // Regions of the current molecule digested during depletion.
+	gcPrefix    *[]uint32   // Cumulative GC counts, built on demand.
+}
+
+// State of lineage tracking during fragmentation:
+type LineageState struct {
+	Enabled  bool
+	MolId    uint64 // The molecule being fragmented.
+	NextFrag uint64
 }
 
 var maxTranscriptId uint64
@@ -84,66 +136,139 @@ func init() {
 	maxTranscriptId = 0
 }
 
-func getGobFile(gobDir string, id uint64, name string) string {
-	subDir := path.Join(gobDir, FirstNDigits(id, 3))
-	if !FileExists(subDir) {
-		err := os.Mkdir(subDir, 0700)
-		if err != nil {
-			L.Fatalf("Error when creating directory %s: %s", subDir, err.Error())
-		}
-	}
-	return path.Join(subDir, fmt.Sprintf("%d_%s.gob", id, name))
-}
-
-func NewTranscript(name string, seq string, level uint64, polyAmax int, gobDir string) (tr *Transcript) {
+func NewTranscript(name string, seq string, level uint64, polyAmax int, store *FragStore) (tr *Transcript) {
 	tr = new(Transcript)
 	tr.id = maxTranscriptId
 	maxTranscriptId++
 	tr.name = name
-	tr.seq.plus = seq + strings.Repeat("A", polyAmax)
-	tr.seq.minus = RevCompDNA(tr.seq.plus)
-	tr.len = uint32(len(tr.seq.plus)) // Length with maximal poly-A tail!
+	tr.seq = NewTrSeq(seq, polyAmax)
+	tr.len = tr.seq.Len() // Length with maximal poly-A tail!
 	tr.exprLevel = level
 	valFragMap := make(map[uint32]StartEndCountMap, 0)
 	tr.FragMap = &valFragMap
 	valFragStructs := make(map[uint32]StartEndCountStruct, 0)
 	tr.FragStructs = &valFragStructs
-
-	if gobDir != "" {
-		tr.gobFile = getGobFile(gobDir, tr.id, tr.name)
-	}
+	valVariants := []*FragVariant{nil}
+	tr.Variants = &valVariants
+	valVarIndex := make(map[string]uint32)
+	tr.varIndex = &valVarIndex
+	tr.varLock = new(sync.Mutex)
+	tr.lineage = new(LineageState)
+	valDigested := make([]Interval, 0)
+	tr.digested = &valDigested
+	tr.gcPrefix = new([]uint32)
+
+	tr.store = store
 
 	return
 }
 
+func (tr Transcript) GetId() uint64 {
+	return tr.id
+}
+
+func (tr Transcript) GetOrigin() string {
+	if tr.origin == "" {
+		return OriginMRNA
+	}
+	return tr.origin
+}
+
 func (tr Transcript) GetName() string {
 	return tr.name
 }
 
+// Plus strand sequence with the maximal poly(A) tail, unpacked on demand:
 func (tr Transcript) GetSeq() string {
-	return tr.seq.plus
+	return tr.seq.Sub(0, tr.len)
 }
 
+// Minus strand sequence, computed on demand:
 func (tr Transcript) GetRevSeq() string {
-	return tr.seq.minus
+	return tr.seq.RevSub(0, tr.len)
+}
+
+// Plus strand bases in [start, end):
+func (tr Transcript) SubSeq(start uint32, end uint32) string {
+	return tr.seq.Sub(start, end)
+}
+
+// Reverse complement of the plus strand bases in [start, end):
+func (tr Transcript) RevSubSeq(start uint32, end uint32) string {
+	return tr.seq.RevSub(start, end)
+}
+
+// Packed strand sequence with the maximal poly(A) tail:
+func (tr Transcript) GetPackedSeq(reverse bool) *PackedSeq {
+	return tr.seq.Pack(reverse)
 }
 
 func (tr Transcript) GetLen() uint32 {
 	return tr.len
 }
 
+// GC content of a region, calculated from cached prefix sums:
+func (tr Transcript) GcContent(start uint32, end uint32) float64 {
+	p := tr.getGcPrefix()
+	return float64(p[end]-p[start]) / float64(end-start)
+}
+
+// Minimum and maximum GC content over the sliding windows of a region:
+func (tr Transcript) GcWindowRange(start uint32, end uint32, w uint32) (float64, float64) {
+	return gcWindowRange(tr.getGcPrefix(), start, end, w)
+}
+
+func (tr Transcript) getGcPrefix() []uint32 {
+	if *tr.gcPrefix == nil {
+		*tr.gcPrefix = tr.seq.GcPrefix()
+	}
+	return *tr.gcPrefix
+}
+
+func (tr Transcript) JettisonGcCache() {
+	*tr.gcPrefix = nil
+}
+
 func (tr Transcript) GetExprLevel() uint64 {
 	return tr.exprLevel
 }
 
-func (tr Transcript) Fragment(tg Targeter, fg Fragmentor, polyAParam *TargetMix, polyAmax int, st FragStater, rand Rander) {
+func (tr Transcript) Fragment(tg Targeter, fg Fragmentor, polyAParam *TargetMix, polyAmax int, capture *PolyACapture, st FragStater, rand Rander) {
 	level := tr.GetExprLevel()
 	// Calculate binding profile:
 	bindProfs := fg.GetBindingProfiles(tr)
+	// Find A-runs supporting internal priming:
+	var runs []Interval
+	if capture.Active() {
+		runs = capture.FindARuns(tr.SubSeq(0, tr.len-uint32(polyAmax)))
+	}
 	var i uint64
 	for ; i < level; i++ {
+		tr.lineage.MolId = i
+		// Contaminating molecules have no poly(A) tail:
+		if tr.origin != "" {
+			// Simulate depletion:
+			if tr.depletion != nil {
+				kept := tr.depletion.Deplete(tr.len, tr.digested, rand)
+				st.UpdateDepletion(tr.GetOrigin(), !kept)
+				if !kept {
+					continue
+				}
+			}
+			fg.Fragment(tr, bindProfs, int(tr.len), st, rand)
+			continue
+		}
 		// Simulate poly-A tail:
 		polyAend := tr.SimulatePolyA(polyAParam, polyAmax, st, rand)
+		// Simulate oligo-dT capture:
+		if capture.Active() {
+			tailLen := uint32(polyAend - (int(tr.len) - polyAmax))
+			var captured bool
+			polyAend, captured = capture.Capture(runs, polyAend, tailLen, st, rand)
+			if !captured {
+				continue
+			}
+		}
 		// Fragment transcript:
 		fg.Fragment(tr, bindProfs, polyAend, st, rand)
 	}
@@ -151,9 +276,14 @@ func (tr Transcript) Fragment(tg Targeter, fg Fragmentor, polyAParam *TargetMix,
 
 func (tr Transcript) Pcr(p Pooler, tc Thermocycler, st FragStater, rand Rander) {
 	tc.Pcr(&tr, p, st, rand)
+	tr.JettisonGcCache()
 }
 
-func (tr Transcript) RegisterFragment(length uint32, start uint32, end uint32) {
+// Register a fragment, returns false if the fragment was destroyed during depletion:
+func (tr Transcript) RegisterFragment(length uint32, start uint32, end uint32, v *FragVariant) bool {
+	if len(*tr.digested) > 0 && Overlaps(*tr.digested, start, end) {
+		return false
+	}
 	startMap, oks := (*tr.FragMap)[length]
 	if !oks {
 		startMap = make(StartEndCountMap, 0)
@@ -166,7 +296,53 @@ func (tr Transcript) RegisterFragment(length uint32, start uint32, end uint32) {
 		startMap[start] = endMap
 	}
 
-	endMap[end]++
+	// Every fragment is distinct when tracking lineage:
+	if tr.lineage.Enabled {
+		lv := &FragVariant{Lineage: &Lineage{MolId: tr.lineage.MolId, FragId: tr.lineage.NextFrag}}
+		if v != nil {
+			lv.StartSite, lv.EndSite = v.StartSite, v.EndSite
+		}
+		tr.lineage.NextFrag++
+		v = lv
+	}
+
+	endMap[FragEnd{end, tr.registerVariant(v)}]++
+	return true
+}
+
+// Track the source molecule and the pre-PCR fragment of every fragment:
+func (tr Transcript) EnableLineage() {
+	tr.lineage.Enabled = true
+}
+
+// Get the index of a fragment variant, register if new:
+func (tr Transcript) registerVariant(v *FragVariant) uint32 {
+	if v == nil {
+		return 0
+	}
+	// Lineage variants are unique, no need to index them:
+	if v.Lineage != nil {
+		return tr.AddVariant(v)
+	}
+	key := v.Key()
+	i, ok := (*tr.varIndex)[key]
+	if ok {
+		return i
+	}
+	i = uint32(len(*tr.Variants))
+	*tr.Variants = append(*tr.Variants, v)
+	(*tr.varIndex)[key] = i
+	return i
+}
+
+// Register a variant without indexing, used for unique variants after flattening:
+func (tr Transcript) AddVariant(v *FragVariant) uint32 {
+	*tr.Variants = append(*tr.Variants, v)
+	return uint32(len(*tr.Variants) - 1)
+}
+
+func (tr Transcript) GetVariant(i uint32) *FragVariant {
+	return (*tr.Variants)[i]
 }
 
 func (tr Transcript) SampleFragment(length uint32, rand Rander) Fragment {
@@ -179,10 +355,11 @@ func (tr Transcript) SampleFragment(length uint32, rand Rander) Fragment {
 	if !oks {
 		L.Fatal("Transcript %s is out of fragments! Simulation is inconsistent!", tr.String())
 	}
+	fg := NewFrag(tr, s.Start[index], s.End[index])
+	fg.variant = tr.DrawVariant(s.Var[index], s.Start[index], s.End[index], s.Count[index], true, rand)
 	// Update counts:
 	s.Count[index] -= 1
 
-	fg := NewFrag(tr, s.Start[index], s.End[index])
 	return fg
 }
 
@@ -198,20 +375,24 @@ func (tr Transcript) Flatten() {
 		t := StartEndCountStruct{}
 		t.Start = make([]uint32, 0)
 		t.End = make([]uint32, 0)
+		t.Var = make([]uint32, 0)
 		t.Count = make([]uint64, 0)
 
 		// Iterate over starts:
 		for start, ecm := range secm {
-			for end, count := range ecm {
+			for fe, count := range ecm {
 				t.Start = append(t.Start, start)
-				t.End = append(t.End, end)
+				t.End = append(t.End, fe.End)
+				t.Var = append(t.Var, fe.Var)
 				t.Count = append(t.Count, count)
 			}
 		}
+		sort.Sort(t)
 		m[length] = t
 	}
-	// Discard FragMap
+	// Discard FragMap and variant index:
 	*tr.FragMap = nil
+	*tr.varIndex = nil
 }
 
 func (tr Transcript) String() string {
@@ -224,56 +405,51 @@ func (tr Transcript) GetFragStructs() *map[uint32]StartEndCountStruct {
 }
 
 func (tr Transcript) Cleanup() {
-	if tr.gobFile == "" {
+	if tr.store == nil {
 		return
 	}
-	err := os.Remove(tr.gobFile)
-	if err != nil {
-		L.Fatalf("Could not remove gob file \"%s\": %s", tr.gobFile, err.Error())
+	if tr.store.Budget != nil {
+		tr.store.Budget.Forget(tr)
 	}
+	tr.store.Delete(tr.id)
 }
 
+// Write the fragments to the store:
 func (tr Transcript) Gob() {
-	if tr.gobFile == "" {
+	if tr.store == nil {
 		return
 	}
-	f, err := os.Create(tr.gobFile)
-	if err != nil {
-		L.Fatalf("Could not create gob file \"%s\": %s", tr.gobFile, err.Error())
-	}
-	defer f.Close()
-	encoder := gob.NewEncoder(f)
-	err = encoder.Encode(*tr.FragStructs)
-	if err != nil {
-		L.Fatalf("Failed to encode fragemnts for transcript %s: %s", tr.name, err.Error())
+	if tr.store.Budget != nil {
+		tr.store.Budget.Release(tr)
+		return
 	}
-	// Discard fragment structure:
+	tr.store.Put(tr.id, *tr.FragStructs, *tr.Variants)
+	// Discard fragment structure and variants:
 	*tr.FragStructs = nil
+	*tr.Variants = nil
 }
 
+// Load the fragments from the store:
 func (tr Transcript) Ungob() {
-	if tr.gobFile == "" {
+	if tr.store == nil {
+		return
+	}
+	if tr.store.Budget != nil {
+		tr.store.Budget.Acquire(tr)
 		return
 	}
 	if *tr.FragStructs != nil {
 		L.Fatalf("Ungob tries to replace data for transcript %s", tr.name)
 	}
-	f, err := os.Open(tr.gobFile)
-	if err != nil {
-		L.Fatalf("Could not open gob file \"%s\": %s", tr.gobFile, err.Error())
-	}
-	defer f.Close()
-	val := make(map[uint32]StartEndCountStruct)
-	decoder := gob.NewDecoder(f)
-	err = decoder.Decode(&val)
-	if err != nil {
-		L.Fatalf("Failed to decode fragments for transcript %s!", tr.name)
-	}
-	*tr.FragStructs = val
+	*tr.FragStructs, *tr.Variants = tr.store.Get(tr.id)
 }
 
 func (tr Transcript) JettisonFragStructs() {
+	if tr.store != nil && tr.store.Budget != nil {
+		tr.store.Budget.Forget(tr)
+	}
 	*tr.FragStructs = nil
+	*tr.Variants = nil
 }
 
 func (tr Transcript) SimulatePolyA(polyAParam *TargetMix, polyAmax int, st FragStater, rand Rander) int {
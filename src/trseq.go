@@ -0,0 +1,131 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+// Transcript sequence packed into two bits per base. The maximal poly(A) tail
+// is not stored and the reverse strand is computed on demand:
+type TrSeq struct {
+	packed *PackedSeq
+	other  map[uint32]byte // Bases other than A, C, G and T.
+	tail   uint32          // Length of the virtual poly(A) tail.
+}
+
+func NewTrSeq(seq string, tail int) *TrSeq {
+	s := &TrSeq{packed: PackDNA(seq), tail: uint32(tail)}
+	for i := 0; i < len(seq); i++ {
+		if _, ok := baseCode(seq[i]); !ok {
+			if s.other == nil {
+				s.other = make(map[uint32]byte)
+			}
+			s.other[uint32(i)] = seq[i]
+		}
+	}
+	return s
+}
+
+// Length including the poly(A) tail:
+func (s TrSeq) Len() uint32 {
+	return s.packed.Len + s.tail
+}
+
+// Length of the virtual poly(A) tail:
+func (s TrSeq) Tail() uint32 {
+	return s.tail
+}
+
+// Two-bit code of the plus strand base at position i and false if the base is ambiguous:
+func (s TrSeq) code(i uint32) (uint64, bool) {
+	if i >= s.packed.Len {
+		return 0, true
+	}
+	return s.packed.Code(i)
+}
+
+// Plus strand bases in [start, end):
+func (s TrSeq) Sub(start uint32, end uint32) string {
+	tmp := make([]byte, end-start)
+	for i := start; i < end; i++ {
+		c, ok := s.code(i)
+		if !ok {
+			tmp[i-start] = s.other[i]
+			continue
+		}
+		tmp[i-start] = packedBases[c]
+	}
+	return string(tmp)
+}
+
+// Reverse complement of the plus strand bases in [start, end):
+func (s TrSeq) RevSub(start uint32, end uint32) string {
+	size := end - start
+	tmp := make([]byte, size)
+	for i := start; i < end; i++ {
+		c, ok := s.code(i)
+		if !ok {
+			tmp[end-1-i] = 'N'
+			continue
+		}
+		tmp[end-1-i] = packedBases[3-c]
+	}
+	return string(tmp)
+}
+
+// Cumulative GC counts of the plus strand, p[i] counts the bases before position i:
+func (s TrSeq) GcPrefix() []uint32 {
+	n := s.Len()
+	p := make([]uint32, n+1)
+	for i := uint32(0); i < n; i++ {
+		p[i+1] = p[i]
+		if c, ok := s.code(i); ok && (c == 1 || c == 2) {
+			p[i+1]++
+		}
+	}
+	return p
+}
+
+// Packed copy of a strand including the poly(A) tail:
+func (s TrSeq) Pack(reverse bool) *PackedSeq {
+	n := s.Len()
+	ps := &PackedSeq{Words: make([]uint64, (n+31)/32), NMask: make([]uint64, (n+63)/64), Len: n}
+	if !reverse {
+		copy(ps.Words, s.packed.Words)
+		copy(ps.NMask, s.packed.NMask)
+		return ps
+	}
+	for i := uint32(0); i < n; i++ {
+		j := n - 1 - i
+		c, ok := s.code(i)
+		if !ok {
+			ps.NMask[j/64] |= 1 << (j % 64)
+			continue
+		}
+		ps.Words[j/32] |= (3 - c) << (2 * (j % 32))
+	}
+	return ps
+}
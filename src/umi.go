@@ -0,0 +1,242 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Unique molecular identifier attached to a pre-PCR molecule:
+type UmiTag struct {
+	Seq  string // Sequence carrying the PCR errors.
+	Orig string // Sequence as attached.
+	Mol  uint64 // Tagged molecule, unique within the transcript.
+}
+
+// Random UMIs attached to the pre-PCR molecules and their output:
+type UmiModel struct {
+	Pattern  string  // Structure of the UMIs as IUPAC codes.
+	SeqError float64 // Sequencing error rate of the UMI bases.
+	out      *bufio.Writer
+	file     *os.File
+}
+
+// Bases matching the IUPAC codes:
+var iupacBases = map[byte]string{
+	'A': "A", 'C': "C", 'G': "G", 'T': "T",
+	'R': "AG", 'Y': "CT", 'S': "CG", 'W': "AT", 'K': "GT", 'M': "AC",
+	'B': "CGT", 'D': "AGT", 'H': "ACT", 'V': "ACG", 'N': "ACGT",
+}
+
+func NewUmiModel(pattern string, seqError float64, file string) *UmiModel {
+	m := new(UmiModel)
+	if pattern == "" {
+		return m
+	}
+	// A number gives the length of fully random UMIs:
+	if n, err := strconv.Atoi(pattern); err == nil {
+		if n < 1 {
+			L.Fatalf("The UMI length must be positive!")
+		}
+		pattern = strings.Repeat("N", n)
+	}
+	pattern = strings.ToUpper(pattern)
+	for i := 0; i < len(pattern); i++ {
+		if _, ok := iupacBases[pattern[i]]; !ok {
+			L.Fatalf("Invalid UMI pattern: %s", pattern)
+		}
+	}
+	if seqError < 0.0 || seqError >= 1.0 {
+		L.Fatalf("The UMI sequencing error rate must be in the interval [0, 1)!")
+	}
+	m.Pattern = pattern
+	m.SeqError = seqError
+	L.PrintfV("UMI pattern: %s, sequencing error rate: %g", pattern, seqError)
+
+	// Open file for the UMI reads:
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			L.Fatalf("Could not create UMI file \"%s\": %s", file, err.Error())
+		}
+		m.file = f
+		m.out = bufio.NewWriter(f)
+		L.PrintfV("UMI reads will be written to %s.", file)
+	}
+	return m
+}
+
+func (m *UmiModel) Active() bool {
+	return m != nil && m.Pattern != ""
+}
+
+// Sample a UMI following the pattern:
+func (m UmiModel) Sample(rand Rander) string {
+	b := make([]byte, len(m.Pattern))
+	for i := 0; i < len(b); i++ {
+		bases := iupacBases[m.Pattern[i]]
+		b[i] = bases[rand.Int63n(int64(len(bases)))]
+	}
+	return string(b)
+}
+
+// Introduce sequencing errors into a UMI:
+func (m UmiModel) Read(umi string, rand Rander) string {
+	if m.SeqError == 0.0 {
+		return umi
+	}
+	b := []byte(umi)
+	for i := range b {
+		if rand.Float64() >= m.SeqError {
+			continue
+		}
+		alt := packedBases[rand.Int63n(4)]
+		for alt == b[i] {
+			alt = packedBases[rand.Int63n(4)]
+		}
+		b[i] = alt
+	}
+	return string(b)
+}
+
+// Attach a random UMI to every pre-PCR molecule. Molecules sharing the same
+// coordinates and variant are split into separate fragments:
+func (tr Transcript) AttachUmis(m *UmiModel, rand Rander) {
+	frags := tr.GetFragStructs()
+	lengths := make([]int, 0, len(*frags))
+	for length := range *frags {
+		lengths = append(lengths, int(length))
+	}
+	sort.Ints(lengths)
+
+	var mol uint64
+	for _, l := range lengths {
+		length := uint32(l)
+		sec := (*frags)[length]
+		t := StartEndCountStruct{}
+		for i := range sec.Count {
+			v := tr.GetVariant(sec.Var[i])
+			for k := uint64(0); k < sec.Count[i]; k++ {
+				umi := m.Sample(rand)
+				nv := new(FragVariant)
+				if v != nil {
+					*nv = *v
+				}
+				nv.Umi = &UmiTag{Seq: umi, Orig: umi, Mol: mol}
+				mol++
+				t.Start = append(t.Start, sec.Start[i])
+				t.End = append(t.End, sec.End[i])
+				t.Var = append(t.Var, tr.AddVariant(nv))
+				t.Count = append(t.Count, 1)
+			}
+		}
+		(*frags)[length] = t
+	}
+}
+
+// Sample the errors of a copy of a UMI tagged clone. The UMI precedes the
+// fragment, so the errors can hit either of them:
+func (m PcrErrorModel) SampleTagged(umi string, seq string, inherited []SeqEdit, rand Rander) (string, []SeqEdit) {
+	shift := uint32(len(umi))
+	shifted := make([]SeqEdit, len(inherited))
+	for i, e := range inherited {
+		e.Pos += shift
+		shifted[i] = e
+	}
+	umiEdits := make([]SeqEdit, 0)
+	edits := make([]SeqEdit, 0, len(inherited)+1)
+	for _, e := range m.SampleEdits(umi+seq, shifted, rand) {
+		if e.Pos < shift {
+			umiEdits = append(umiEdits, e)
+			continue
+		}
+		e.Pos -= shift
+		edits = append(edits, e)
+	}
+	return ApplyEdits(umi, umiEdits), edits
+}
+
+// Length of the UMI attached to a fragment:
+func (v *FragVariant) UmiLen() uint32 {
+	if v == nil || v.Umi == nil {
+		return 0
+	}
+	return uint32(len(v.Umi.Seq))
+}
+
+// Sampled fragment with its UMI as read:
+type UmiFrag struct {
+	Fragment
+	umi    string
+	inName bool // The UMI is appended to the name.
+}
+
+// Read the UMI of a sampled fragment, and write it into the UMI file if present:
+func (m UmiModel) Label(f Fragment, rand Rander) Fragment {
+	tag := f.GetUmi()
+	if tag == nil {
+		return f
+	}
+	uf := UmiFrag{f, m.Read(tag.Seq, rand), m.out == nil}
+	if m.out != nil {
+		fmt.Fprintf(m.out, "%s\n%s\n", strings.Fields(f.String())[0], uf.umi)
+	}
+	return uf
+}
+
+func (uf UmiFrag) SetId(id uint64) Fragment {
+	uf.Fragment = uf.Fragment.SetId(id)
+	return uf
+}
+
+// Header recording the tagged molecule and the attached UMI for evaluating deduplication:
+func (uf UmiFrag) String() string {
+	spl := strings.SplitN(uf.Fragment.String(), "\n", 2)
+	header := spl[0]
+	if uf.inName {
+		name := strings.Fields(header)[0]
+		header = name + "_" + uf.umi + header[len(name):]
+	}
+	tag := uf.GetUmi()
+	header += fmt.Sprintf(" UmiMol=%d:%d UmiTrue=%s", uf.GetTranscript().GetId(), tag.Mol, tag.Orig)
+	return header + "\n" + spl[1]
+}
+
+func (m *UmiModel) Close() {
+	if m == nil || m.out == nil {
+		return
+	}
+	m.out.Flush()
+	m.file.Close()
+}
@@ -29,7 +29,6 @@
 package main
 
 import (
-	"fmt"
 	"os"
 	"strings"
 )
@@ -58,21 +57,23 @@ func RevCompDNA(s string) string {
 	return string(tmp)
 }
 
-func StringToSlice(s string) []string {
-	return strings.Split(s, "\n")
+// Complement of a single base as a string:
+func complementBase(b byte) string {
+	switch b {
+	case 'A':
+		return "T"
+	case 'T':
+		return "A"
+	case 'G':
+		return "C"
+	case 'C':
+		return "G"
+	}
+	return "N"
 }
 
-func FirstNDigits(i uint64, n int) string {
-	if i < 100 {
-		return "000"
-	}
-	tmp := fmt.Sprintf("%d", i)
-	l := len(tmp)
-	s := n
-	if l < n {
-		s = l
-	}
-	return tmp[0:s]
+func StringToSlice(s string) []string {
+	return strings.Split(s, "\n")
 }
 
 func FileExists(fn string) bool {
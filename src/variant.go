@@ -0,0 +1,133 @@
+/*
+* Copyright (C) 2013 EMBL - European Bioinformatics Institute
+*
+* This program is free software: you can redistribute it
+* and/or modify it under the terms of the GNU General
+* Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your
+* option) any later version.
+*
+* This program is distributed in the hope that it will be
+* useful, but WITHOUT ANY WARRANTY; without even the
+* implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE. See the GNU General Public License
+* for more details.
+*
+* Neither the institution name nor the name rlsim
+* can be used to endorse or promote products derived from
+* this software without prior written permission. For
+* written permission, please contact <sbotond@ebi.ac.uk>.
+
+* Products derived from this software may not be called
+* rlsim nor may rlsim appear in their
+* names without prior written permission of the developers.
+* You should have received a copy of the GNU General Public
+* License along with this program. If not, see
+* <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "fmt"
+
+// Sequence information attached to fragments which cannot be
+// described by transcript coordinates alone:
+type FragVariant struct {
+	StartSite string // Primer imprinted bases at the start (plus strand).
+	EndSite   string // Primer imprinted bases at the end (plus strand).
+	Lineage   *Lineage
+	Errors    []SeqEdit // Errors introduced during PCR.
+	Junction  *PcrJunction
+	Umi       *UmiTag
+	Pending   *PcrPending // Copies whose errors are sampled when drawn.
+}
+
+// Origin of a pre-PCR fragment. The identifiers are unique within a transcript:
+type Lineage struct {
+	MolId  uint64 // Source RNA molecule.
+	FragId uint64 // Pre-PCR fragment.
+}
+
+// Variant identifier used when registering fragments:
+func (v *FragVariant) Key() string {
+	if v.Lineage != nil {
+		return fmt.Sprintf("%s|%s|%d|%d", v.StartSite, v.EndSite, v.Lineage.MolId, v.Lineage.FragId)
+	}
+	return v.StartSite + "|" + v.EndSite
+}
+
+// Apply the variant to the plus strand sequence of a fragment:
+func (v *FragVariant) Apply(seq string) string {
+	b := []byte(seq)
+	copy(b, v.StartSite)
+	if len(v.EndSite) > 0 && len(v.EndSite) <= len(b) {
+		copy(b[len(b)-len(v.EndSite):], v.EndSite)
+	}
+	return ApplyEdits(string(b), v.Errors)
+}
+
+// Plus strand template sequence of a fragment, joined at the breakpoint for PCR chimeras:
+func (v *FragVariant) Template(tr Transcripter, start uint32, end uint32) string {
+	if v != nil && v.Junction != nil {
+		j := v.Junction
+		switch {
+		case j.Partner == "":
+			return tr.SubSeq(start, j.X) + tr.SubSeq(j.Y, end)
+		case j.Head:
+			return j.Seq + tr.SubSeq(j.Y, end)
+		}
+		return tr.SubSeq(start, j.X) + j.Seq
+	}
+	return tr.SubSeq(start, end)
+}
+
+// Transcript coordinate of a position within the fragment, and whether it
+// falls into the second part of a PCR chimera:
+func (v *FragVariant) TrCoord(start uint32, pos uint32) (uint32, bool) {
+	if v != nil && v.Junction != nil && start+pos >= v.Junction.X {
+		return v.Junction.Y + (start + pos - v.Junction.X), true
+	}
+	return start + pos, false
+}
+
+// Copy of the variant carrying additional PCR errors:
+func (v *FragVariant) WithErrors(edits []SeqEdit) *FragVariant {
+	nv := &FragVariant{Errors: edits}
+	if v != nil {
+		nv.StartSite, nv.EndSite, nv.Lineage, nv.Junction, nv.Umi = v.StartSite, v.EndSite, v.Lineage, v.Junction, v.Umi
+	}
+	return nv
+}
+
+// Positions of the primer imprinted bases differing from the template:
+func SiteMismatches(site string, template string) []int {
+	mm := make([]int, 0)
+	for i := 0; i < len(site) && i < len(template); i++ {
+		if site[i] != template[i] {
+			mm = append(mm, i)
+		}
+	}
+	return mm
+}
+
+// Copy the variants of a transcript for encoding, the first element is a placeholder
+// for fragments without variants:
+func variantValues(vs []*FragVariant) []FragVariant {
+	vals := make([]FragVariant, len(vs))
+	for i := 1; i < len(vs); i++ {
+		vals[i] = *vs[i]
+	}
+	return vals
+}
+
+// Restore the variants of a transcript copied by variantValues:
+func variantPointers(vals []FragVariant) []*FragVariant {
+	if len(vals) == 0 {
+		return []*FragVariant{nil}
+	}
+	vs := make([]*FragVariant, len(vals))
+	for i := 1; i < len(vs); i++ {
+		vs[i] = &vals[i]
+	}
+	return vs
+}